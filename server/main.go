@@ -1,13 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
+	"math/big"
 	"math/rand"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,12 +30,61 @@ import (
 const (
 	LISTEN_PORT = 53
 
-	ACK_IP = "3.4.0.0" // server-received ACK (A)
+	// Status codes: chunk and ACK2 queries are answered with 3.4.0.<code> (A) or
+	// ::ffff:3.4.0.<code> (AAAA). Older clients only look for an answer at all.
+	STATUS_STORED       = "3.4.0.0" // chunk stored / ACK2 accepted
+	STATUS_DUPLICATE    = "3.4.0.1" // chunk already stored, or token already used
+	STATUS_DELIVERED    = "3.4.0.2" // message already ACK2'd by its receiver: stop sending
+	STATUS_MALFORMED    = "3.4.0.3" // label does not parse
+	STATUS_QUOTA        = "3.4.0.4" // a store quota is full (see Quotas)
+	STATUS_BAD_CRC      = "3.4.0.5" // chunk checksum mismatch: resend this chunk
+	STATUS_REPLAY       = "3.4.0.6" // replay token outside the window (check the clock)
+	STATUS_UNAUTHORIZED = "3.4.0.7" // not allowlisted, not a group member/publisher, or ACK2 MAC mismatch
 )
 
 var (
 	LISTEN_IP   string
 	BASE_DOMAIN string
+
+	// LEGACY_IDS_UNTIL ends the migration window for 5-char IDs (zero = accept forever)
+	LEGACY_IDS_UNTIL time.Time
+
+	// REGISTRY_PATH holds the server X25519 key and registered nodes (see Node Registry).
+	// SERVER_KEY_HEX overrides the stored server key.
+	REGISTRY_PATH  string
+	SERVER_KEY_HEX string
+
+	// GROUPS (PEYK_GROUPS="<gid>:<m1>+<m2>+...,..."): gid -> member node IDs.
+	// Chunks addressed to a gid fan out into every member's queue except the sender's.
+	GROUPS map[string][]string
+
+	// CHANNELS (PEYK_CHANNELS="<cid>:<p1>+<p2>+...,..."): cid -> publisher node IDs.
+	// Posts are stored once per channel and read by cursor (see Channels).
+	CHANNELS map[string][]string
+
+	// BLIND_KEY enables ID blinding (PEYK_BLIND_KEY); nil = plain IDs only
+	BLIND_KEY []byte
+
+	// obfsKey keys the label obfuscation seal (PEYK_OBFS_KEY, default BASE_DOMAIN)
+	obfsKey []byte
+
+	// Store quotas (0 = unlimited); QUOTA_EVICT drops the oldest messages to make
+	// room instead of refusing the new chunk (PEYK_QUOTA_POLICY=evict|reject).
+	MAX_CHUNKS_PER_MSG int
+	MAX_MSGS_PER_RID   int
+	MAX_BYTES_PER_RID  int
+	MAX_TOTAL_BYTES    int
+	QUOTA_EVICT        bool
+
+	// MAX_MESSAGE_TTL caps the "t<minutes>" TTL a sender may ask for (PEYK_MAX_TTL_MINUTES).
+	MAX_MESSAGE_TTL time.Duration
+
+	// LONGPOLL_MAX caps how long a TCP poll may be held (PEYK_LONGPOLL_MAX_SECONDS; 0 = never).
+	LONGPOLL_MAX time.Duration
+
+	// ALLOWLIST (closed deployment): nid -> pinned public key hex ("" = any key).
+	// nil means open: any node may register, unregistered nodes may poll.
+	ALLOWLIST map[string]string
 )
 
 // Debug knobs
@@ -48,6 +110,70 @@ const (
 	RESEND_BACKOFF_MIN   = 100 * time.Millisecond
 )
 
+// ACK2 authentication: "k<mac>" on ACK2, "a<commit>" label next to chunk 1
+const ACK2_MAC_LEN = 16
+
+// Replay protection: "r<ts><nonce>" meta label on chunks and ACK2s
+// (ts = Unix seconds, 7 base36 chars; nonce = 4 Base32 chars).
+// Tokens outside [now-REPLAY_WINDOW, now+REPLAY_SKEW] are dropped; tokens inside
+// are remembered per sender until they leave the window, so each is accepted once.
+// A v2 chunk's CRC covers its token (see replayBoundFrame), and v2 chunks without
+// a token are refused once the legacy window (LEGACY_IDS_UNTIL) ends.
+const (
+	REPLAY_TOKEN_LEN     = 11
+	REPLAY_WINDOW        = 10 * time.Minute
+	REPLAY_SKEW          = 2 * time.Minute
+	REQUIRE_REPLAY_TOKEN = false // true = refuse tokenless (pre-replay-protection) clients
+)
+
+// Registration: polls for registered rids need "<nonce>.<token>"
+const (
+	POLL_MAC_LEN         = 16
+	POLL_WINDOW          = 30 * time.Second
+	REQUIRE_REGISTRATION = false // true = refuse polls for rids that never registered
+)
+
+// Channels: publishers sign every chunk with "s<mac>" under their node secret;
+// the server keeps the last CHANNEL_MAX_POSTS chunks per channel for CHANNEL_TTL.
+const (
+	PUBLISH_MAC_LEN   = 16
+	CHANNEL_TTL       = 24 * time.Hour
+	CHANNEL_MAX_POSTS = 4096
+)
+
+// Sender status: bitmaps for messages with more chunks than this would not fit
+// a 512-byte UDP answer, so those get "NOP".
+const STAT_MAX_TOT = 512
+
+// Priority: chunks may carry "p<n>" (0 bulk ... 3 urgent, PRIORITY_DEFAULT if absent).
+// Polls serve the highest effective priority first, then the oldest message; a
+// message gains a level for every PRIORITY_AGING since it arrived (see pollOrderLocked).
+// Once every chunk has gone out, a message sits out RESEND_HOLD before its next
+// pass, giving the receiver time to ACK2 and lower classes a turn.
+const (
+	PRIORITY_DEFAULT = 1
+	PRIORITY_MAX     = 3
+	PRIORITY_AGING   = 15 * time.Second
+	RESEND_HOLD      = 2 * time.Second
+)
+
+// ID blinding: with PEYK_BLIND_KEY set, sid/rid on the wire are rotating
+// pseudonyms "0" + Base32(HMAC(key, "blind|<id>|<epoch>"))[:8], epoch = Unix
+// time / 1h. "0" is not a Base32 char, so a pseudonym never passes for a real ID.
+const (
+	BLIND_ID_MARK = '0'
+	BLIND_ID_LEN  = 9
+	BLIND_EPOCH   = time.Hour
+)
+
+// IDs: protocol v1 uses 5-char node/message IDs; v2 (ext token "v2") uses 8-16 chars
+// for mid and allows them for node IDs too.
+const (
+	LEGACY_ID_LEN = 5
+	MIN_ID_LEN    = 8
+	MAX_ID_LEN    = 16
+)
+
 // DNS Types
 const (
 	QTYPE_A    = 1
@@ -57,7 +183,7 @@ const (
 
 // ───────────────────────── Memory Store ─────────────────────────
 
-// ChunkEnvelope = idx-tot-sid-rid-payload
+// ChunkEnvelope = idx-tot-mid-sid-rid-payload[-ext...][-c<crc>]
 type ChunkEnvelope struct {
 	Idx     int
 	Tot     int
@@ -65,12 +191,20 @@ type ChunkEnvelope struct {
 	SID     string
 	RID     string
 	Payload string
+	Ext     []string // extension tokens after payload (relayed verbatim)
+	CRC     string   // 4-char chunk checksum, empty for legacy senders
 	AddedAt time.Time
 }
 
 type sendState struct {
 	Count    int
 	LastSent time.Time
+	PassedAt time.Time // when the last full pass over the message's chunks ended
+}
+
+type ack2Commit struct {
+	Commit  string
+	AddedAt time.Time
 }
 
 // messageStore:
@@ -88,9 +222,54 @@ var (
 	sendCursor   = make(map[string]int)
 	sendStates   = make(map[string]sendState)
 
+	// ack2Commits: map[messageKey]commitment registered by the sender with chunk 1
+	// (first 16 Base32 chars of SHA-256 over the ACK2 MAC it expects)
+	ack2Commits = make(map[string]ack2Commit)
+
+	// ack2Relayed: map[ackKey] last ACK2 relayed to the sender of an acked message,
+	// queued again when the sender keeps uploading it (see requeueAck2Locked)
+	ack2Relayed = make(map[string]string)
+
+	// groupDeliveries: map[messageKey] per-member ACK2 state of a message sent to a group
+	groupDeliveries = make(map[string]*groupDelivery)
+
+	// channelLogs: map[channelID] broadcast chunks, stored once for all subscribers
+	channelLogs = make(map[string]*channelLog)
+
+	// ridBytes / storeBytes: approximate memory held by messageStore and channelLogs, per
+	// receiver (or channel) and in total (see chunkBytes); kept in step with every insert and removal
+	ridBytes   = make(map[string]int)
+	storeBytes int
+
+	// replaySeen: map[senderID]map[tokenKey]ts — sliding replay window per sender
+	replaySeen = make(map[string]map[string]time.Time)
+
 	storeMu sync.Mutex
 )
 
+// Node registry: nid -> identity key, and the derived per-node secret
+var (
+	serverKey   *ecdh.PrivateKey
+	registry    = make(map[string]registeredNode)
+	nodeSecrets = make(map[string][]byte)
+	pollNonces  = make(map[string]time.Time) // "rid|nonce" -> first use, kept 3 windows
+	regPath     string
+	regMu       sync.Mutex
+
+	// blindIndex: pseudonym -> nid for the epochs around blindIndexEpoch (see unblindID).
+	// Guarded by regMu.
+	blindIndex      map[string]string
+	blindIndexEpoch int64
+	blindIndexSize  int
+)
+
+type groupDelivery struct {
+	GID     string
+	Members []string // receivers (the group minus the sender)
+	Acked   map[string]bool
+	AddedAt time.Time
+}
+
 // purgeMessageLocked removes all traces of a message for a receiver.
 // storeMu must be held by the caller.
 func purgeMessageLocked(rid, msgKey string) {
@@ -115,6 +294,9 @@ func purgeMessageLocked(rid, msgKey string) {
 	logIf(ENABLE_CLEANUP_LOG, "cleanup rid=%s key=%s keyFull=%s", rid, msgKey, keyFull)
 	if msgs, ok := messageStore[rid]; ok {
 		before := len(msgs[msgKey])
+		for _, c := range msgs[msgKey] {
+			accountLocked(rid, -chunkBytes(c))
+		}
 		delete(msgs, msgKey)
 		logIf(ENABLE_CLEANUP_LOG, "cleanup store rid=%s key=%s removedChunks=%d remainingKeys=%d", rid, msgKey, before, len(msgs))
 		if len(msgs) == 0 {
@@ -178,6 +360,200 @@ func purgeMessageByKeyLocked(msgKey string) {
 	}
 }
 
+// ackGroupMemberLocked records a member's ACK2 for a group message and drops
+// that member's copy of the chunks. It returns the delivered/total counts
+// (n=0 for a repeated ACK2) and false if member is not a receiver.
+// storeMu must be held by the caller.
+func ackGroupMemberLocked(g *groupDelivery, msgKey, member string) (int, int, bool) {
+	found := false
+	for _, m := range g.Members {
+		if m == member {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, len(g.Members), false
+	}
+	if g.Acked[member] {
+		return 0, len(g.Members), true
+	}
+	g.Acked[member] = true
+	if start, ok := sendFirstAt[fmt.Sprintf("%s|%s", member, msgKey)]; ok {
+		logEvent("[MSG-TX]", "\x1b[33m", "ack received gid=%s -> rid=%s took=%s", g.GID, member, time.Since(start))
+	}
+	purgeMessageLocked(member, msgKey)
+	if len(g.Acked) == len(g.Members) {
+		delete(groupDeliveries, msgKey)
+	}
+	return len(g.Acked), len(g.Members), true
+}
+
+// queueExpiredLocked tells the sender that a message expired undelivered:
+// "EXPIRED-<sid>-<tot>-<mid>[-g<n>of<m>]" goes into its ACK2 queue, with the
+// group tally when the message went to a group. Delivered messages are skipped.
+// storeMu must be held by the caller.
+func queueExpiredLocked(c ChunkEnvelope, msgKey string) {
+	if lastSeen, seen := ack2Seen[fmt.Sprintf("%s:%d:%s", c.SID, c.Tot, c.MID)]; seen && time.Since(lastSeen) <= ACK2_TTL {
+		return
+	}
+	note := fmt.Sprintf("EXPIRED-%s-%d-%s", c.SID, c.Tot, c.MID)
+	if g, ok := groupDeliveries[msgKey]; ok {
+		note += fmt.Sprintf("-g%dof%d", len(g.Acked), len(g.Members))
+		delete(groupDeliveries, msgKey)
+	}
+	delete(ack2Commits, msgKey)
+	deliveryAcks[c.SID] = append(deliveryAcks[c.SID], note)
+	notifyPollersLocked(c.SID)
+	atomic.AddUint64(&statExpired, 1)
+	logEvent("[GC]", "\x1b[33m", "expired undelivered sid=%s -> rid=%s parts=%d mid=%s ttl=%s", c.SID, c.RID, c.Tot, c.MID, messageTTL(c.Ext))
+}
+
+// ack2MemberTag signs a group ACK2 for one member under that member's node secret.
+// The k<mac> is no use here: every member derives it from the same envelope, so
+// any of them could present it on behalf of another.
+func ack2MemberTag(secret []byte, sid string, tot int, mid, member string) string {
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "ack2m|%s|%d|%s|%s", sid, tot, mid, member)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(m.Sum(nil)))[:ACK2_MAC_LEN]
+}
+
+// ack2MemberAuthorized checks the u<tag> of a group ACK2 against the member's node
+// secret. An unregistered member needs no tag where it may also poll without one.
+func ack2MemberAuthorized(sid string, tot int, mid, member, tag string) bool {
+	regMu.Lock()
+	secret, registered := nodeSecrets[member]
+	regMu.Unlock()
+	if !registered {
+		return !REQUIRE_REGISTRATION && ALLOWLIST == nil
+	}
+	return tag != "" && hmac.Equal([]byte(tag), []byte(ack2MemberTag(secret, sid, tot, mid, member)))
+}
+
+// groupReceivers returns the members other than sid, or nil if sid is not a member.
+func groupReceivers(members []string, sid string) []string {
+	var out []string
+	isMember := false
+	for _, m := range members {
+		if m == sid {
+			isMember = true
+			continue
+		}
+		out = append(out, m)
+	}
+	if !isMember || len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// parseIDLists reads "<id>:<n1>+<n2>+...,..." from env var name (empty = none).
+// Used for PEYK_GROUPS (gid -> members) and PEYK_CHANNELS (cid -> publishers).
+func parseIDLists(name, v string) map[string][]string {
+	if v == "" {
+		return nil
+	}
+	lists := make(map[string][]string)
+	for _, entry := range strings.Split(v, ",") {
+		id, list, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		id = strings.ToLower(id)
+		if !ok || !isBase32ID(id) {
+			log.Fatalf("invalid %s entry %q: want <id>:<n1>+<n2>+...", name, entry)
+		}
+		for _, n := range strings.Split(list, "+") {
+			n = strings.ToLower(strings.TrimSpace(n))
+			if !isBase32ID(n) {
+				log.Fatalf("invalid node ID %q in %s entry %s", n, name, id)
+			}
+			lists[id] = append(lists[id], n)
+		}
+	}
+	return lists
+}
+
+// ───────────────────────── Quotas ─────────────────────────
+//
+// Limits on what senders can park in messageStore: chunks per message (tot),
+// messages and bytes per receiver, and bytes overall. A chunk that would break a
+// limit is refused with STATUS_QUOTA, or with QUOTA_EVICT the oldest messages (of that
+// receiver, or anywhere for the global cap) are dropped until it fits. Chunks of a
+// message already in the store only count against the byte limits. Channel logs
+// count against the byte limits too, with the channel ID as the receiver.
+
+// chunkBytes approximates the memory one stored chunk costs (strings plus map/slice overhead).
+func chunkBytes(c ChunkEnvelope) int {
+	n := 96 + len(c.MID) + len(c.SID) + len(c.RID) + len(c.Payload) + len(c.CRC)
+	for _, e := range c.Ext {
+		n += len(e)
+	}
+	return n
+}
+
+// accountLocked adds delta bytes to rid's usage. storeMu must be held by the caller.
+func accountLocked(rid string, delta int) {
+	storeBytes += delta
+	ridBytes[rid] += delta
+	if ridBytes[rid] <= 0 {
+		delete(ridBytes, rid)
+	}
+}
+
+// oldestMessageLocked finds the message whose first chunk is oldest, in rid's queue
+// or (rid == "") anywhere, skipping skipKey in every queue (a group message's other
+// copies). storeMu must be held by the caller.
+func oldestMessageLocked(rid, skipKey string) (string, string, bool) {
+	var (
+		bestRID, bestKey string
+		bestAt           time.Time
+		found            bool
+	)
+	for r, msgs := range messageStore {
+		if rid != "" && r != rid {
+			continue
+		}
+		for key, chunks := range msgs {
+			if key == skipKey || len(chunks) == 0 {
+				continue
+			}
+			if !found || chunks[0].AddedAt.Before(bestAt) {
+				bestRID, bestKey, bestAt, found = r, key, chunks[0].AddedAt, true
+			}
+		}
+	}
+	return bestRID, bestKey, found
+}
+
+// makeRoomLocked reports whether a chunk of size bytes for rid/key fits the quotas,
+// evicting old messages first when QUOTA_EVICT is set. reserve is what the whole
+// upload adds to the store (size times the group targets), checked against the
+// global cap. storeMu must be held by the caller.
+func makeRoomLocked(rid, key string, size, reserve int) bool {
+	for {
+		_, known := messageStore[rid][key]
+		ridFull := (MAX_MSGS_PER_RID > 0 && !known && len(messageStore[rid]) >= MAX_MSGS_PER_RID) ||
+			(MAX_BYTES_PER_RID > 0 && ridBytes[rid]+size > MAX_BYTES_PER_RID)
+		totalFull := MAX_TOTAL_BYTES > 0 && storeBytes+reserve > MAX_TOTAL_BYTES
+		if !ridFull && !totalFull {
+			return true
+		}
+		if !QUOTA_EVICT {
+			return false
+		}
+		scope := ""
+		if ridFull {
+			scope = rid
+		}
+		victimRID, victimKey, ok := oldestMessageLocked(scope, key)
+		if !ok {
+			return false
+		}
+		logEvent("[QUOTA]", "\x1b[33m", "evicted rid=%s key=%s to make room for rid=%s key=%s", victimRID, victimKey, rid, key)
+		purgeMessageLocked(victimRID, victimKey)
+		atomic.AddUint64(&statQuotaEvict, 1)
+	}
+}
+
 // ───────────────────────── Stats ─────────────────────────
 
 var (
@@ -194,12 +570,24 @@ var (
 	statPollRequests uint64
 
 	statTxA    uint64 // generic A sends (incl ACK)
-	statTxAAAA uint64 // polling payload via AAAA
+	statTxAAAA uint64 // polling payload and status answers via AAAA
 	statTxAPay uint64 // polling payload via A (fallback)
 	statTxTXT  uint64 // legacy (should remain 0 now)
 
-	statParseFail uint64
-	statIgnored   uint64
+	statParseFail  uint64
+	statIgnored    uint64
+	statRxBadCRC   uint64 // chunks rejected by checksum
+	statAck2Auth   uint64 // ACK2s rejected by MAC commitment or member tag
+	statReplay     uint64 // chunks/ACK2s dropped for a stale, future or missing replay token
+	statPollAuth   uint64 // polls rejected: missing/bad/expired/reused token, unregistered or not allowlisted
+	statDummy      uint64 // cover-traffic polls/chunks recognized and discarded
+	statChanPosts  uint64 // channel chunks stored
+	statChanAuth   uint64 // channel posts dropped: not a publisher or bad signature
+	statQuota      uint64 // chunks refused by a store quota
+	statQuotaEvict uint64 // messages evicted to make room (QUOTA_EVICT)
+	statStatQuery  uint64 // sender status (chunk bitmap) queries answered
+	statExpired    uint64 // messages expired undelivered (sender notified)
+	statHeldPolls  uint64 // TCP long polls parked until data or timeout
 )
 
 func logIf(enabled bool, format string, args ...interface{}) {
@@ -224,6 +612,55 @@ func init() {
 
 	LISTEN_IP = getEnvOrDefault("PEYK_LISTEN_IP", "0.0.0.0")
 	BASE_DOMAIN = getEnvRequired("PEYK_DOMAIN")
+	if v := getEnvOrDefault("PEYK_LEGACY_IDS_UNTIL", ""); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			log.Fatalf("invalid PEYK_LEGACY_IDS_UNTIL=%q: want YYYY-MM-DD", v)
+		}
+		LEGACY_IDS_UNTIL = t
+	}
+	obfsSum := sha256.Sum256([]byte("peyk-obfs:" + getEnvOrDefault("PEYK_OBFS_KEY", BASE_DOMAIN)))
+	obfsKey = obfsSum[:]
+	if v := getEnvOrDefault("PEYK_BLIND_KEY", ""); v != "" {
+		sum := sha256.Sum256([]byte("peyk-blind:" + v))
+		BLIND_KEY = sum[:]
+	}
+	GROUPS = parseIDLists("PEYK_GROUPS", getEnvOrDefault("PEYK_GROUPS", ""))
+	CHANNELS = parseIDLists("PEYK_CHANNELS", getEnvOrDefault("PEYK_CHANNELS", ""))
+	for cid := range CHANNELS {
+		if _, ok := GROUPS[cid]; ok {
+			log.Fatalf("PEYK_CHANNELS: %s is already a group ID", cid)
+		}
+	}
+	MAX_CHUNKS_PER_MSG = getEnvInt("PEYK_MAX_CHUNKS_PER_MSG", 512)
+	MAX_MSGS_PER_RID = getEnvInt("PEYK_MAX_MSGS_PER_RID", 256)
+	MAX_BYTES_PER_RID = getEnvInt("PEYK_MAX_BYTES_PER_RID", 4<<20)
+	MAX_TOTAL_BYTES = getEnvInt("PEYK_MAX_TOTAL_BYTES", 256<<20)
+	MAX_MESSAGE_TTL = time.Duration(getEnvInt("PEYK_MAX_TTL_MINUTES", 24*60)) * time.Minute
+	if MAX_MESSAGE_TTL == 0 {
+		log.Fatalf("invalid PEYK_MAX_TTL_MINUTES=0: want at least 1")
+	}
+	LONGPOLL_MAX = time.Duration(getEnvInt("PEYK_LONGPOLL_MAX_SECONDS", 25)) * time.Second
+	switch policy := getEnvOrDefault("PEYK_QUOTA_POLICY", "reject"); policy {
+	case "reject":
+	case "evict":
+		QUOTA_EVICT = true
+	default:
+		log.Fatalf("invalid PEYK_QUOTA_POLICY %q: want reject or evict", policy)
+	}
+	REGISTRY_PATH = getEnvOrDefault("PEYK_REGISTRY", "peyk_registry.json")
+	SERVER_KEY_HEX = getEnvOrDefault("PEYK_SERVER_KEY", "")
+	if v := getEnvOrDefault("PEYK_ALLOWLIST", ""); v != "" {
+		ALLOWLIST = make(map[string]string)
+		for _, entry := range strings.Split(v, ",") {
+			nid, pub, _ := strings.Cut(strings.TrimSpace(entry), ":")
+			nid = strings.ToLower(nid)
+			if !isBase32ID(nid) {
+				log.Fatalf("invalid PEYK_ALLOWLIST entry %q: want <nid>[:<pubkey hex>]", entry)
+			}
+			ALLOWLIST[nid] = strings.ToLower(pub)
+		}
+	}
 }
 
 func getEnvRequired(key string) string {
@@ -242,6 +679,18 @@ func getEnvOrDefault(key, def string) string {
 	return val
 }
 
+func getEnvInt(key string, def int) int {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		log.Fatalf("invalid %s=%q: want a non-negative integer", key, val)
+	}
+	return n
+}
+
 func loadDotEnv(path string) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -285,6 +734,18 @@ func main() {
 	}
 	defer conn.Close()
 
+	if err := loadRegistry(REGISTRY_PATH); err != nil {
+		log.Fatalf("registry %s: %v", REGISTRY_PATH, err)
+	}
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	log.Printf("server key: %s", strings.ToLower(enc.EncodeToString(serverKey.PublicKey().Bytes())))
+	if ALLOWLIST != nil {
+		log.Printf("allowlist mode: %d nodes", len(ALLOWLIST))
+	}
+	for cid, pubs := range CHANNELS {
+		log.Printf("channel %s: publishers %s", cid, strings.Join(pubs, ","))
+	}
+
 	go garbageCollector()
 	go statsLogger()
 	go statsBar()
@@ -324,26 +785,57 @@ func (u udpResponder) Send(resp []byte) error {
 	return err
 }
 
+// tcpResponder writes length-prefixed answers to one TCP connection. Held long
+// polls answer from their own goroutines, so writes are serialized by mu and
+// held counts the connection's parked polls. ctx is cancelled when the read loop
+// exits; the connection is closed under mu afterwards, so no write follows it.
 type tcpResponder struct {
 	conn net.Conn
+	mu   *sync.Mutex
+	held *int32
+	ctx  context.Context
 }
 
 func (t tcpResponder) Send(resp []byte) error {
 	if len(resp) > 65535 {
 		return fmt.Errorf("dns response too large: %d", len(resp))
 	}
-	lenBuf := make([]byte, 2)
-	binary.BigEndian.PutUint16(lenBuf, uint16(len(resp)))
-	if _, err := t.conn.Write(lenBuf); err != nil {
-		return err
+	frame := make([]byte, 2, 2+len(resp))
+	binary.BigEndian.PutUint16(frame, uint16(len(resp)))
+	frame = append(frame, resp...)
+	t.mu.Lock()
+	if t.ctx.Err() != nil {
+		t.mu.Unlock()
+		return net.ErrClosed
 	}
-	_, err := t.conn.Write(resp)
+	_, err := t.conn.Write(frame)
+	t.mu.Unlock()
 	if err == nil {
 		atomic.AddUint64(&statTxTCP, 1)
 	}
 	return err
 }
 
+// hold reserves a parked-poll slot on this connection (LONGPOLL_MAX_PER_CONN)
+// and on the server (LONGPOLL_MAX_PARKED).
+func (t tcpResponder) hold() bool {
+	if atomic.AddInt32(t.held, 1) > LONGPOLL_MAX_PER_CONN {
+		atomic.AddInt32(t.held, -1)
+		return false
+	}
+	if atomic.AddInt32(&parkedPolls, 1) > LONGPOLL_MAX_PARKED {
+		atomic.AddInt32(&parkedPolls, -1)
+		atomic.AddInt32(t.held, -1)
+		return false
+	}
+	return true
+}
+
+func (t tcpResponder) release() {
+	atomic.AddInt32(&parkedPolls, -1)
+	atomic.AddInt32(t.held, -1)
+}
+
 func serveTCP() {
 	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", LISTEN_IP, LISTEN_PORT))
 	if err != nil {
@@ -361,9 +853,15 @@ func serveTCP() {
 }
 
 func handleTCPConn(conn net.Conn) {
-	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := tcpResponder{conn: conn, mu: new(sync.Mutex), held: new(int32), ctx: ctx}
+	defer func() {
+		cancel()
+		resp.mu.Lock()
+		conn.Close()
+		resp.mu.Unlock()
+	}()
 	remote := conn.RemoteAddr().String()
-	resp := tcpResponder{conn: conn}
 	lenBuf := make([]byte, 2)
 	for {
 		if _, err := io.ReadFull(conn, lenBuf); err != nil {
@@ -425,6 +923,214 @@ func parseQNameNoCompression(msg []byte, start int) (string, int, bool) {
 	return strings.Join(labels, "."), i, true
 }
 
+// ───────────────────────── Label Obfuscation ─────────────────────────
+//
+// The qname prefix (everything before BASE_DOMAIN) can be disguised so chunk,
+// ACK2, poll and registration queries don't look machine-generated:
+//
+//  1. pack:  chars [a-z0-9-.] -> base-38 integer -> bytes (saves ~1/3)
+//  2. seal:  nonce[2] | packed XOR HMAC keystream | tag[3], keyed by OBFS_KEY
+//  3. codec: bytes -> innocuous labels ("words": pronounceable syllables,
+//     "cdn": hash-like labels plus an edge/static decoy label)
+//
+// The nonce makes every query look different; the tag tells the server a
+// disguised prefix from a plain one. Codecs are pluggable via labelCodecs.
+
+const OBFS_ALPHABET = "abcdefghijklmnopqrstuvwxyz0123456789-."
+
+// labelCodec maps sealed bytes to a qname prefix and back.
+type labelCodec interface {
+	Encode(data []byte) string
+	Decode(prefix string) ([]byte, bool)
+}
+
+var labelCodecs = map[string]labelCodec{
+	"words": wordsCodec{},
+	"cdn":   cdnCodec{},
+}
+
+// obfsKeystream XORs data with HMAC(key, "obfs|" + nonce + block counter).
+func obfsKeystream(key, nonce, data []byte) []byte {
+	out := make([]byte, len(data))
+	for i := 0; i < len(data); i += sha256.Size {
+		m := hmac.New(sha256.New, key)
+		m.Write([]byte("obfs|"))
+		m.Write(nonce)
+		m.Write([]byte{byte(i / sha256.Size)})
+		block := m.Sum(nil)
+		for j := i; j < len(data) && j-i < len(block); j++ {
+			out[j] = data[j] ^ block[j-i]
+		}
+	}
+	return out
+}
+
+func obfsTag(key, nonce, ct []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("obfs-tag|"))
+	m.Write(nonce)
+	m.Write(ct)
+	return m.Sum(nil)[:3]
+}
+
+// obfsOpen reverses the seal and unpacking; ok is false for anything not sealed under key.
+func obfsOpen(key, sealed []byte) (string, bool) {
+	if len(sealed) < 2+1+3 {
+		return "", false
+	}
+	nonce, ct, tag := sealed[:2], sealed[2:len(sealed)-3], sealed[len(sealed)-3:]
+	if !hmac.Equal(tag, obfsTag(key, nonce, ct)) {
+		return "", false
+	}
+	n := new(big.Int).SetBytes(obfsKeystream(key, nonce, ct))
+	radix := big.NewInt(int64(len(OBFS_ALPHABET)))
+	one := big.NewInt(1)
+	var rev []byte
+	for n.Cmp(one) > 0 {
+		var d big.Int
+		n.DivMod(n, radix, &d)
+		rev = append(rev, OBFS_ALPHABET[d.Int64()])
+	}
+	if n.Cmp(one) != 0 {
+		return "", false
+	}
+	for i, j := 0, len(rev)-1; i < j; i, j = i+1, j-1 {
+		rev[i], rev[j] = rev[j], rev[i]
+	}
+	return string(rev), true
+}
+
+// deobfuscate returns the plain qname for a disguised one. Plain chunk, ACK2
+// and v1.* queries are recognized by their first label and never decoded.
+func deobfuscate(domain string) (string, bool) {
+	prefix := strings.TrimSuffix(domain, "."+BASE_DOMAIN)
+	first, _, _ := strings.Cut(prefix, ".")
+	if prefix == domain || first == "v1" || strings.Contains(first, "-") {
+		return "", false
+	}
+	for _, codec := range labelCodecs {
+		sealed, ok := codec.Decode(prefix)
+		if !ok {
+			continue
+		}
+		if plain, ok := obfsOpen(obfsKey, sealed); ok {
+			return plain + "." + BASE_DOMAIN, true
+		}
+	}
+	return "", false
+}
+
+// bytesToDigits/digitsToBytes convert with a 0x01 sentinel so leading zero bytes survive.
+func bytesToDigits(data []byte, radix int) []int {
+	n := new(big.Int).SetBytes(append([]byte{1}, data...))
+	r := big.NewInt(int64(radix))
+	var digits []int
+	for n.Sign() > 0 {
+		var d big.Int
+		n.DivMod(n, r, &d)
+		digits = append(digits, int(d.Int64()))
+	}
+	return digits
+}
+
+func digitsToBytes(digits []int, radix int) ([]byte, bool) {
+	n := new(big.Int)
+	r := big.NewInt(int64(radix))
+	for i := len(digits) - 1; i >= 0; i-- {
+		n.Mul(n, r)
+		n.Add(n, big.NewInt(int64(digits[i])))
+	}
+	b := n.Bytes()
+	if len(b) == 0 || b[0] != 1 {
+		return nil, false
+	}
+	return b[1:], true
+}
+
+// wordsCodec: base-100 digits as consonant+vowel syllables, 3-6 syllables per label.
+type wordsCodec struct{}
+
+const (
+	wordsConsonants = "bcdfghjklmnprstvwxyz"
+	wordsVowels     = "aeiou"
+)
+
+func (wordsCodec) Encode(data []byte) string {
+	var (
+		sb   strings.Builder
+		word int
+		size = 3 + rand.Intn(4)
+	)
+	for _, d := range bytesToDigits(data, len(wordsConsonants)*len(wordsVowels)) {
+		if word == size {
+			sb.WriteByte('.')
+			word, size = 0, 3+rand.Intn(4)
+		}
+		sb.WriteByte(wordsConsonants[d/len(wordsVowels)])
+		sb.WriteByte(wordsVowels[d%len(wordsVowels)])
+		word++
+	}
+	return sb.String()
+}
+
+func (wordsCodec) Decode(prefix string) ([]byte, bool) {
+	s := strings.ReplaceAll(prefix, ".", "")
+	if len(s)%2 != 0 {
+		return nil, false
+	}
+	digits := make([]int, 0, len(s)/2)
+	for i := 0; i < len(s); i += 2 {
+		c := strings.IndexByte(wordsConsonants, s[i])
+		v := strings.IndexByte(wordsVowels, s[i+1])
+		if c < 0 || v < 0 {
+			return nil, false
+		}
+		digits = append(digits, c*len(wordsVowels)+v)
+	}
+	return digitsToBytes(digits, len(wordsConsonants)*len(wordsVowels))
+}
+
+// cdnCodec: base-36 labels of 12-16 chars followed by one decoy label, like
+// "d4f8k2m1q9z0x3.e12ab7c0pq9w.edge". The decoy is always dropped on decode.
+type cdnCodec struct{}
+
+var cdnDecoys = []string{"edge", "cdn", "static", "assets", "img", "media", "s3", "cache"}
+
+func (cdnCodec) Encode(data []byte) string {
+	digits := bytesToDigits(data, 36)
+	var (
+		labels []string
+		cur    []byte
+		size   = 12 + rand.Intn(5)
+	)
+	for _, d := range digits {
+		if len(cur) == size {
+			labels = append(labels, string(cur))
+			cur, size = nil, 12+rand.Intn(5)
+		}
+		cur = append(cur, "0123456789abcdefghijklmnopqrstuvwxyz"[d])
+	}
+	labels = append(labels, string(cur), cdnDecoys[rand.Intn(len(cdnDecoys))])
+	return strings.Join(labels, ".")
+}
+
+func (cdnCodec) Decode(prefix string) ([]byte, bool) {
+	dot := strings.LastIndexByte(prefix, '.')
+	if dot < 0 {
+		return nil, false
+	}
+	s := strings.ReplaceAll(prefix[:dot], ".", "")
+	digits := make([]int, len(s))
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte("0123456789abcdefghijklmnopqrstuvwxyz", s[i])
+		if d < 0 {
+			return nil, false
+		}
+		digits[i] = d
+	}
+	return digitsToBytes(digits, 36)
+}
+
 // ───────────────────────── Packet Router ─────────────────────────
 
 func handlePacket(data []byte, resp responseWriter, remote string) {
@@ -447,64 +1153,228 @@ func handlePacket(data []byte, resp responseWriter, remote string) {
 
 	logIf(ENABLE_VERBOSE_LOG, "RX pkt from=%s txid=%s qtype=%d qname=%s", remote, txIDHex, q.QType, domain)
 
+	// Route on the de-obfuscated name; responses still echo the wire name (domain).
+	qname := domain
+	if plain, ok := deobfuscate(domain); ok {
+		qname = plain
+		logIf(ENABLE_VERBOSE_LOG, "deobfuscated qname=%s", qname)
+	}
+
 	// Polling (NOW: AAAA preferred, fallback to A)
-	if strings.HasPrefix(domain, "v1.sync.") {
+	if strings.HasPrefix(qname, "v1.sync.") {
 		// Allow AAAA (28) and A (1). Ignore TXT now.
 		if q.QType != QTYPE_AAAA && q.QType != QTYPE_A {
 			atomic.AddUint64(&statIgnored, 1)
 			return
 		}
 		atomic.AddUint64(&statPollRequests, 1)
-		handlePolling(resp, remote, txID, domain, q.QType, q.QClass)
+		handlePolling(resp, remote, txID, domain, qname, q.QType, q.QClass)
 		logIf(ENABLE_VERBOSE_LOG, "done poll from=%s txid=%s took=%s", remote, txIDHex, time.Since(start))
 		return
 	}
 
+	// Channel read: v1.chan.<cid>.<cursor>[.<nonce>]
+	if strings.HasPrefix(qname, "v1.chan.") {
+		if q.QType != QTYPE_AAAA && q.QType != QTYPE_A {
+			atomic.AddUint64(&statIgnored, 1)
+			return
+		}
+		atomic.AddUint64(&statPollRequests, 1)
+		handleChannelPoll(resp, remote, txID, domain, qname, q.QType, q.QClass)
+		return
+	}
+
+	// Registration (AAAA preferred, fallback to A)
+	if strings.HasPrefix(qname, "v1.reg.") {
+		if q.QType != QTYPE_AAAA && q.QType != QTYPE_A {
+			atomic.AddUint64(&statIgnored, 1)
+			return
+		}
+		handleRegister(resp, remote, txID, domain, qname, q.QType, q.QClass)
+		return
+	}
+
 	// Inbound chunk or ACK2 (A/AAAA)
 	if q.QType != QTYPE_A && q.QType != QTYPE_AAAA {
 		atomic.AddUint64(&statIgnored, 1)
 		return
 	}
-	handleInboundOrAck2(resp, remote, txID, domain, q.QType, q.QClass)
+	handleInboundOrAck2(resp, remote, txID, domain, qname, q.QType, q.QClass)
 	logIf(ENABLE_VERBOSE_LOG, "done A from=%s txid=%s took=%s", remote, txIDHex, time.Since(start))
 }
 
 // ───────────────────────── Inbound + ACK2 ─────────────────────────
 
-func handleInboundOrAck2(resp responseWriter, remote string, txID []byte, domain string, qtype, qclass uint16) {
-	prefix := strings.TrimSuffix(domain, "."+BASE_DOMAIN)
+// unblindID maps a wire ID to a node ID. Plain IDs come back unchanged; a
+// pseudonym maps to a known node (registered, allowlisted, a group or a channel),
+// trying the previous, current and next epoch. ok is false for a pseudonym of no
+// known node: callers refuse it rather than route it as if it were a real ID.
+func unblindID(id string) (string, bool) {
+	if !isBlindID(id) {
+		return id, true
+	}
+	if BLIND_KEY == nil {
+		return id, false
+	}
+	epoch := blindEpoch(time.Now())
+
+	regMu.Lock()
+	defer regMu.Unlock()
+	if blindIndex == nil || blindIndexEpoch != epoch || blindIndexSize != len(registry)+len(ALLOWLIST)+len(GROUPS)+len(CHANNELS) {
+		blindIndex = make(map[string]string)
+		add := func(nid string) {
+			for e := epoch - 1; e <= epoch+1; e++ {
+				blindIndex[blindID(BLIND_KEY, nid, e)] = nid
+			}
+		}
+		for nid := range registry {
+			add(nid)
+		}
+		for nid := range ALLOWLIST {
+			add(nid)
+		}
+		for gid := range GROUPS {
+			add(gid)
+		}
+		for cid := range CHANNELS {
+			add(cid)
+		}
+		blindIndexEpoch = epoch
+		blindIndexSize = len(registry) + len(ALLOWLIST) + len(GROUPS) + len(CHANNELS)
+	}
+	if nid, ok := blindIndex[id]; ok {
+		return nid, true
+	}
+	return id, false
+}
+
+func handleInboundOrAck2(resp responseWriter, remote string, txID []byte, domain, qname string, qtype, qclass uint16) {
+	prefix := strings.TrimSuffix(qname, "."+BASE_DOMAIN)
 	label := prefix
 	if dot := strings.IndexByte(prefix, '.'); dot >= 0 {
 		label = prefix[:dot]
 	}
 
-	// ACK2: ack2-sid-tot-mid (mid required)
+	// Sender status: stat-sid-mid-nonce[-token]
+	if strings.HasPrefix(label, "stat-") {
+		handleStatQuery(resp, remote, txID, domain, prefix, qtype, qclass)
+		return
+	}
+
+	// ACK2: ack2-sid-tot-mid[-k<mac>][-m<member>][.u<tag>] (mid required; member and tag for group messages)
 	if strings.HasPrefix(label, "ack2-") {
 		parts := strings.Split(label, "-")
-		if len(parts) != 4 {
+		if len(parts) < 4 || len(parts) > 6 {
+			sendAResponse(resp, txID, domain, STATUS_MALFORMED, qtype, qclass)
 			return
 		}
-		sid := strings.ToLower(parts[1])
+		sid, sidOK := unblindID(strings.ToLower(parts[1]))
 		tot := atoiSafe(parts[2])
 		mid := strings.ToLower(parts[3])
 		if tot <= 0 {
+			sendAResponse(resp, txID, domain, STATUS_MALFORMED, qtype, qclass)
+			return
+		}
+		if !sidOK || !nodeAllowed(sid) {
+			sendAResponse(resp, txID, domain, STATUS_UNAUTHORIZED, qtype, qclass)
 			return
 		}
+		mac, member := "", ""
+		for _, t := range parts[4:] {
+			t = strings.ToLower(t)
+			switch {
+			case len(t) == 1+ACK2_MAC_LEN && t[0] == 'k':
+				mac = t[1:]
+			case len(t) > 1 && t[0] == 'm' && isWireID(t[1:]):
+				var ok bool
+				if member, ok = unblindID(t[1:]); !ok {
+					sendAResponse(resp, txID, domain, STATUS_UNAUTHORIZED, qtype, qclass)
+					return
+				}
+			default:
+				sendAResponse(resp, txID, domain, STATUS_MALFORMED, qtype, qclass)
+				return
+			}
+		}
 		log.Printf("DEBUG-ACK2-IN: sid=%s, mid=%s, tot=%d", sid, mid, tot)
 
+		rts, rok := checkReplayToken(prefix)
+		if !rok {
+			atomic.AddUint64(&statReplay, 1)
+			logEvent("[ACK2-RX]", "\x1b[31m", "REJECTED stale ack sid=%s tot=%d mid=%s from=%s", sid, tot, mid, remote)
+			sendAResponse(resp, txID, domain, STATUS_REPLAY, qtype, qclass)
+			return
+		}
+
+		if member != "" && !ack2MemberAuthorized(sid, tot, mid, member, metaToken(prefix, 'u', ACK2_MAC_LEN)) {
+			atomic.AddUint64(&statAck2Auth, 1)
+			logEvent("[ACK2-RX]", "\x1b[31m", "REJECTED unsigned group ack sid=%s mid=%s member=%s from=%s", sid, mid, member, remote)
+			sendAResponse(resp, txID, domain, STATUS_UNAUTHORIZED, qtype, qclass)
+			return
+		}
+
 		ack := fmt.Sprintf("ACK2-%s-%d-%s", sid, tot, mid)
+		if mac != "" {
+			ack += "-k" + mac
+		}
 
 		storeMu.Lock()
+		if replayed := markReplayLocked(sid, "ack2|"+metaToken(prefix, 'r', REPLAY_TOKEN_LEN), rts); replayed {
+			// Same token again: a resolver retry or a captured query. Already handled once.
+			storeMu.Unlock()
+			atomic.AddUint64(&statIgnored, 1)
+			logIf(ENABLE_ACK2_LOG, "replayed ACK2 token sid=%s tot=%d mid=%s from=%s", sid, tot, mid, remote)
+			sendAResponse(resp, txID, domain, STATUS_DUPLICATE, qtype, qclass)
+			return
+		}
+		msgKey := fmt.Sprintf("%s:%s:%d", sid, mid, tot)
+		if c, ok := ack2Commits[msgKey]; ok && ack2Commitment(mac) != c.Commit {
+			storeMu.Unlock()
+			atomic.AddUint64(&statAck2Auth, 1)
+			logEvent("[ACK2-RX]", "\x1b[31m", "REJECTED forged ack sid=%s tot=%d mid=%s from=%s", sid, tot, mid, remote)
+			sendAResponse(resp, txID, domain, STATUS_UNAUTHORIZED, qtype, qclass)
+			return
+		}
+		if g, ok := groupDeliveries[msgKey]; ok {
+			n, m, accepted := ackGroupMemberLocked(g, msgKey, member)
+			if !accepted {
+				storeMu.Unlock()
+				atomic.AddUint64(&statIgnored, 1)
+				logEvent("[ACK2-RX]", "\x1b[31m", "REJECTED group ack sid=%s mid=%s member=%q not a receiver of %s from=%s", sid, mid, member, g.GID, remote)
+				sendAResponse(resp, txID, domain, STATUS_UNAUTHORIZED, qtype, qclass)
+				return
+			}
+			if n > 0 {
+				// Aggregate receipt: every new member ACK2 tells the sender "delivered to n of m".
+				tally := fmt.Sprintf("%s-g%dof%d", ack, n, m)
+				deliveryAcks[sid] = append(deliveryAcks[sid], tally)
+				notifyPollersLocked(sid)
+				if n == m {
+					delete(ack2Commits, msgKey)
+					ackKey := fmt.Sprintf("%s:%d:%s", sid, tot, mid)
+					ack2Seen[ackKey] = time.Now()
+					ack2Relayed[ackKey] = tally
+				}
+			}
+			storeMu.Unlock()
+
+			atomic.AddUint64(&statRxAck2, 1)
+			logEvent("[ACK2-RX]", "\x1b[36m", "group delivery sid=%s gid=%s mid=%s member=%s delivered=%d/%d from=%s", sid, g.GID, mid, member, n, m, remote)
+			sendAResponse(resp, txID, domain, STATUS_STORED, qtype, qclass)
+			return
+		}
+		delete(ack2Commits, msgKey)
 		ackKey := fmt.Sprintf("%s:%d:%s", sid, tot, mid)
 		lastSeen, seen := ack2Seen[ackKey]
 		if !seen || time.Since(lastSeen) > ACK2_TTL {
 			deliveryAcks[sid] = append(deliveryAcks[sid], ack)
+			notifyPollersLocked(sid)
 			ack2Seen[ackKey] = time.Now()
+			ack2Relayed[ackKey] = ack
 		}
 		queueLen := len(deliveryAcks[sid])
 
 		// Drop stored chunks for this message (stop resends after ACK2).
-		msgKey := fmt.Sprintf("%s:%s:%d", sid, mid, tot)
 		ridMatches := make(map[string]struct{})
 		for rid, msgs := range messageStore {
 			if _, ok := msgs[msgKey]; ok {
@@ -529,40 +1399,121 @@ func handleInboundOrAck2(resp responseWriter, remote string, txID []byte, domain
 		logEvent("[ACK2-RX]", "\x1b[36m", "delivery confirmed sid=%s tot=%d mid=%s from=%s queue=%d", sid, tot, mid, remote, queueLen)
 		logIf(ENABLE_ACK2_LOG, "ACK2 stored sid=%s tot=%d mid=%s (queue=%d) from=%s", sid, tot, mid, queueLen, remote)
 
-		// Keep ACK response as A with fixed ACK_IP (unchanged)
-		sendAResponse(resp, txID, domain, ACK_IP, qtype, qclass)
+		sendAResponse(resp, txID, domain, STATUS_STORED, qtype, qclass)
 		return
 	}
 	// Chunk: idx-tot-mid-sid-rid-payload (mid required)
 	labels := strings.Split(label, "-")
 	if len(labels) < 6 {
+		sendAResponse(resp, txID, domain, STATUS_MALFORMED, qtype, qclass)
 		return
 	}
 
 	idx := atoiSafe(labels[0])
 	tot := atoiSafe(labels[1])
-	if !isBase32ID(labels[2]) || !isBase32ID(labels[3]) || !isBase32ID(labels[4]) {
+	if !isBase32ID(labels[2]) || !isWireID(labels[3]) || !isWireID(labels[4]) {
+		sendAResponse(resp, txID, domain, STATUS_MALFORMED, qtype, qclass)
 		return
 	}
 	mid := strings.ToLower(labels[2])
-	sid := strings.ToLower(labels[3])
-	rid := strings.ToLower(labels[4])
-	payload := strings.Join(labels[5:], "-")
+	sid, sidOK := unblindID(strings.ToLower(labels[3]))
+	rid, ridOK := unblindID(strings.ToLower(labels[4]))
+	payload := labels[5]
+	if !sidOK || !ridOK {
+		// A stale or unknown pseudonym: refuse it before the CRC (which is over the
+		// real IDs) so the sender isn't told to resend, and before storing it under
+		// a name no poller asks for.
+		atomic.AddUint64(&statIgnored, 1)
+		logIf(ENABLE_RX_CHUNK_LOG, "unknown pseudonym sid=%s rid=%s from=%s", labels[3], labels[4], remote)
+		sendAResponse(resp, txID, domain, STATUS_UNAUTHORIZED, qtype, qclass)
+		return
+	}
 
 	if idx <= 0 || tot <= 0 || idx > tot || payload == "" {
+		sendAResponse(resp, txID, domain, STATUS_MALFORMED, qtype, qclass)
 		return
 	}
 
-	env := ChunkEnvelope{
-		Idx:     idx,
+	// Base32 payload never contains '-', so anything after it is an extension token.
+	ext, crc := splitChunkExt(labels[6:])
+	if !validChunkIDs(chunkVersion(ext), mid, sid, rid) {
+		atomic.AddUint64(&statIgnored, 1)
+		logIf(ENABLE_RX_CHUNK_LOG, "bad ids v=%d mid=%s sid=%s rid=%s from=%s", chunkVersion(ext), mid, sid, rid, remote)
+		sendAResponse(resp, txID, domain, STATUS_MALFORMED, qtype, qclass)
+		return
+	}
+	if !nodeAllowed(sid) || !nodeAllowed(rid) {
+		atomic.AddUint64(&statIgnored, 1)
+		logIf(ENABLE_RX_CHUNK_LOG, "not allowlisted sid=%s rid=%s from=%s", sid, rid, remote)
+		sendAResponse(resp, txID, domain, STATUS_UNAUTHORIZED, qtype, qclass)
+		return
+	}
+	// Fan-out: a chunk for a group is queued once per member (rid stays the gid in the frame).
+	targets := []string{rid}
+	if members, ok := GROUPS[rid]; ok {
+		if targets = groupReceivers(members, sid); targets == nil {
+			atomic.AddUint64(&statIgnored, 1)
+			logIf(ENABLE_RX_CHUNK_LOG, "sid=%s is not a member of group %s from=%s", sid, rid, remote)
+			sendAResponse(resp, txID, domain, STATUS_UNAUTHORIZED, qtype, qclass)
+			return
+		}
+	}
+	rtok := metaToken(prefix, 'r', REPLAY_TOKEN_LEN)
+	if crc != "" {
+		// Senders from before the token was bound send the CRC of the bare frame.
+		frame := chunkFrame(idx, tot, mid, sid, rid, payload, ext)
+		if chunkCRC(replayBoundFrame(frame, rtok)) != crc && !(legacyIDsAllowed() && chunkCRC(frame) == crc) {
+			// Not stored: the sender resends this chunk on STATUS_BAD_CRC.
+			atomic.AddUint64(&statRxBadCRC, 1)
+			logIf(ENABLE_RX_CHUNK_LOG, "BAD CRC chunk sid=%s->%s %d/%d got=%s from=%s", sid, rid, idx, tot, crc, remote)
+			sendAResponse(resp, txID, domain, STATUS_BAD_CRC, qtype, qclass)
+			return
+		}
+		crc = chunkCRC(frame) // relayed without the token, so receivers check the bare frame
+	}
+
+	if MAX_CHUNKS_PER_MSG > 0 && tot > MAX_CHUNKS_PER_MSG {
+		atomic.AddUint64(&statQuota, 1)
+		logIf(ENABLE_RX_CHUNK_LOG, "QUOTA tot=%d > %d sid=%s->%s from=%s", tot, MAX_CHUNKS_PER_MSG, sid, rid, remote)
+		sendAResponse(resp, txID, domain, STATUS_QUOTA, qtype, qclass)
+		return
+	}
+
+	rts, rok := checkReplayToken(prefix)
+	if rtok == "" && chunkVersion(ext) >= 2 && !legacyIDsAllowed() {
+		rok = false // v2 senders have always sent a token; a missing one was stripped
+	}
+	if !rok {
+		atomic.AddUint64(&statReplay, 1)
+		logIf(ENABLE_RX_CHUNK_LOG, "STALE chunk sid=%s->%s %d/%d from=%s", sid, rid, idx, tot, remote)
+		sendAResponse(resp, txID, domain, STATUS_REPLAY, qtype, qclass)
+		return
+	}
+	if isCoverChunk(sid, mid, rtok) {
+		// Answer exactly like a real chunk so the dummy stays indistinguishable on the wire.
+		atomic.AddUint64(&statDummy, 1)
+		logIf(ENABLE_RX_CHUNK_LOG, "cover chunk sid=%s from=%s", sid, remote)
+		sendAResponse(resp, txID, domain, STATUS_STORED, qtype, qclass)
+		return
+	}
+
+	env := ChunkEnvelope{
+		Idx:     idx,
 		Tot:     tot,
 		MID:     mid,
 		SID:     sid,
 		RID:     rid,
 		Payload: payload,
+		Ext:     ext,
+		CRC:     crc,
 		AddedAt: time.Now(),
 	}
 
+	if _, ok := CHANNELS[rid]; ok {
+		handleChannelPost(resp, remote, txID, domain, prefix, env, rts, qtype, qclass)
+		return
+	}
+
 	key := fmt.Sprintf("%s:%s:%d", sid, mid, tot)
 	ackKey := fmt.Sprintf("%s:%d:%s", sid, tot, mid)
 
@@ -573,31 +1524,73 @@ func handleInboundOrAck2(resp responseWriter, remote string, txID []byte, domain
 
 	storeMu.Lock()
 	if lastSeen, seen := ack2Seen[ackKey]; seen && time.Since(lastSeen) <= ACK2_TTL {
+		requeueAck2Locked(sid, ackKey)
 		storeMu.Unlock()
 		atomic.AddUint64(&statIgnored, 1)
 		logIf(ENABLE_ACK2_LOG, "drop chunk for acked message sid=%s tot=%d mid=%s from=%s", sid, tot, mid, remote)
-		sendAResponse(resp, txID, domain, ACK_IP, qtype, qclass)
+		sendAResponse(resp, txID, domain, STATUS_DELIVERED, qtype, qclass)
 		return
 	}
-	if messageStore[rid] == nil {
-		messageStore[rid] = make(map[string][]ChunkEnvelope)
+	// Quotas are checked for every target before anything is stored, so a group
+	// chunk lands in all member queues or in none.
+	size := chunkBytes(env)
+	fresh := make([]string, 0, len(targets))
+	for _, t := range targets {
+		stored := false
+		for _, c := range messageStore[t][key] {
+			if c.Idx == env.Idx {
+				stored = true
+				break
+			}
+		}
+		if !stored {
+			fresh = append(fresh, t)
+		}
+	}
+	for _, t := range fresh {
+		if !makeRoomLocked(t, key, size, size*len(fresh)) {
+			storeMu.Unlock()
+			atomic.AddUint64(&statQuota, 1)
+			logEvent("[QUOTA]", "\x1b[31m", "REFUSED chunk sid=%s -> rid=%s %d/%d (msgs=%d bytes=%d total=%d) from=%s",
+				sid, t, idx, tot, len(messageStore[t]), ridBytes[t], storeBytes, remote)
+			sendAResponse(resp, txID, domain, STATUS_QUOTA, qtype, qclass)
+			return
+		}
 	}
 
+	if markReplayLocked(sid, fmt.Sprintf("%s|%d", rtok, idx), rts) {
+		// ACK so a retrying resolver stops, but never store the same upload twice.
+		storeMu.Unlock()
+		atomic.AddUint64(&statRxDupChunks, 1)
+		logIf(ENABLE_RX_CHUNK_LOG, "REPLAY chunk sid=%s->%s %d/%d from=%s", sid, rid, idx, tot, remote)
+		sendAResponse(resp, txID, domain, STATUS_DUPLICATE, qtype, qclass)
+		return
+	}
 	keyFull := fmt.Sprintf("%s|%s", rid, key)
 	if _, ok := msgFirstAt[keyFull]; !ok {
 		msgFirstAt[keyFull] = time.Now()
 	}
 
-	for _, c := range messageStore[rid][key] {
-		if c.Idx == env.Idx {
-			dup = true
-			break
+	dup = len(fresh) == 0
+	for _, t := range fresh {
+		if messageStore[t] == nil {
+			messageStore[t] = make(map[string][]ChunkEnvelope)
 		}
+		messageStore[t][key] = append(messageStore[t][key], env)
+		accountLocked(t, size)
+		notifyPollersLocked(t)
 	}
-
 	if !dup {
-		messageStore[rid][key] = append(messageStore[rid][key], env)
-		msgSize = len(messageStore[rid][key])
+		msgSize = len(messageStore[targets[0]][key])
+	}
+	if _, isGroup := GROUPS[rid]; isGroup && groupDeliveries[key] == nil {
+		groupDeliveries[key] = &groupDelivery{GID: rid, Members: targets, Acked: make(map[string]bool), AddedAt: time.Now()}
+	}
+
+	if commit := metaToken(prefix, 'a', ACK2_MAC_LEN); commit != "" {
+		if _, ok := ack2Commits[key]; !ok {
+			ack2Commits[key] = ack2Commit{Commit: commit, AddedAt: time.Now()}
+		}
 	}
 
 	firstAt := msgFirstAt[keyFull]
@@ -622,50 +1615,765 @@ func handleInboundOrAck2(resp responseWriter, remote string, txID []byte, domain
 		logEvent("[MSG-RX]", "\x1b[32m", "complete sid=%s -> rid=%s parts=%d took=%s", sid, rid, tot, time.Since(firstAt))
 	}
 
-	// ACK for inbound chunk remains A
-	sendAResponse(resp, txID, domain, ACK_IP, qtype, qclass)
+	status := STATUS_STORED
+	if dup {
+		status = STATUS_DUPLICATE
+	}
+	sendAResponse(resp, txID, domain, status, qtype, qclass)
 }
 
-// ───────────────────────── Polling ─────────────────────────
-
-func handlePolling(resp responseWriter, remote string, txID []byte, domain string, qtype, qclass uint16) {
-	parts := strings.Split(domain, ".")
-	if len(parts) < 3 {
-		logIf(ENABLE_VERBOSE_LOG, "poll malformed qname=%s from=%s -> NOP", domain, remote)
+// ───────────────────────── Sender Status ─────────────────────────
+//
+// "stat-<sid>-<mid>-<nonce>[-<token>].<rid>-<tot>" lets a sender ask which chunks
+// of its message the server holds, without waiting for the receiver's ACK2. The
+// nonce/token pair is the sender's poll token (see Node Registry), so only
+// the sender can ask. rid and tot name the queue entry, so the lookup is direct
+// rather than a scan of every queue. The answer is a poll-style payload:
+//
+//	STAT-<tot>-<bitmap>  chunk i is held if bit i-1 is set (hex, MSB first)
+//	STAT-DELIVERED       the receiver already ACK2'd the message
+//	STAT-NONE            no chunk of the message is held (never arrived, or expired)
+//	NOP                  malformed or not authorized, or tot over STAT_MAX_TOT
+//
+// Chunks stay queued until the ACK2, so the bitmap does not shrink when the
+// receiver polls them. A group message reports the chunks its member queues
+// hold between them.
+
+func handleStatQuery(resp responseWriter, remote string, txID []byte, domain, prefix string, qtype, qclass uint16) {
+	labels := strings.Split(strings.ToLower(prefix), ".")
+	parts := strings.Split(labels[0], "-")
+	if len(labels) < 2 || len(parts) < 4 || len(parts) > 5 || !isWireID(parts[1]) || !isBase32ID(parts[2]) {
+		sendPollingPayload(resp, txID, domain, "NOP", qtype, qclass)
+		return
+	}
+	dest := strings.Split(labels[1], "-")
+	if len(dest) != 2 || !isWireID(dest[0]) || atoiSafe(dest[1]) <= 0 {
+		sendPollingPayload(resp, txID, domain, "NOP", qtype, qclass)
+		return
+	}
+	sid, sidOK := unblindID(parts[1])
+	rid, ridOK := unblindID(dest[0])
+	tot := atoiSafe(dest[1])
+	mid := parts[2]
+	nonce, token := parts[3], ""
+	if len(parts) == 5 {
+		token = parts[4]
+	}
+	if !sidOK || !ridOK || !nodeAllowed(sid) || !pollAuthorized(sid, nonce, token) {
+		atomic.AddUint64(&statPollAuth, 1)
+		logEvent("[STAT]", "\x1b[31m", "REJECTED unauthenticated status query sid=%s mid=%s from=%s", sid, mid, remote)
 		sendPollingPayload(resp, txID, domain, "NOP", qtype, qclass)
 		return
 	}
-	rid := strings.ToLower(parts[2])
+	atomic.AddUint64(&statStatQuery, 1)
+
+	queues := []string{rid}
+	if members, ok := GROUPS[rid]; ok {
+		queues = groupReceivers(members, sid)
+	}
+	key := fmt.Sprintf("%s:%s:%d", sid, mid, tot)
+	ackKey := fmt.Sprintf("%s:%d:%s", sid, tot, mid)
 
-	// 1) ACK2s
+	answer := "NOP"
 	storeMu.Lock()
-	if acks, ok := deliveryAcks[rid]; ok && len(acks) > 0 {
-		ack := acks[0]
-		remaining := len(acks) - 1
-		if len(acks) == 1 {
-			delete(deliveryAcks, rid)
-		} else {
-			deliveryAcks[rid] = acks[1:]
+	var held map[int]bool
+	for _, q := range queues {
+		chunks, ok := messageStore[q][key]
+		if !ok {
+			continue
 		}
-		storeMu.Unlock()
+		if held == nil {
+			held = make(map[int]bool)
+		}
+		for _, c := range chunks {
+			held[c.Idx] = true
+		}
+	}
+	switch lastSeen, seen := ack2Seen[ackKey]; {
+	case seen && time.Since(lastSeen) <= ACK2_TTL:
+		answer = "STAT-DELIVERED"
+		requeueAck2Locked(sid, ackKey)
+	case held == nil:
+		answer = "STAT-NONE"
+	case tot <= STAT_MAX_TOT:
+		bitmap := make([]byte, (tot+7)/8)
+		for idx := range held {
+			if idx >= 1 && idx <= tot {
+				bitmap[(idx-1)/8] |= 0x80 >> uint((idx-1)%8)
+			}
+		}
+		answer = fmt.Sprintf("STAT-%d-%s", tot, hex.EncodeToString(bitmap))
+	}
+	storeMu.Unlock()
 
-		logIf(ENABLE_POLL_LOG, "poll rid=%s from=%s -> ACK2 (%s) remaining=%d viaQ=%d", rid, remote, ack, remaining, qtype)
-		logEvent("[ACK2-TX]", "\x1b[35m", "sent to rid=%s ack=%s remaining=%d viaQ=%d", rid, ack, remaining, qtype)
-		sendPollingPayload(resp, txID, domain, ack, qtype, qclass)
+	logIf(ENABLE_POLL_LOG, "status query sid=%s rid=%s mid=%s tot=%d from=%s -> %s", sid, rid, mid, tot, remote, answer)
+	sendPollingPayload(resp, txID, domain, answer, qtype, qclass)
+}
+
+// ───────────────────────── Node Registry ─────────────────────────
+//
+// "v1.reg.<nid>.<pub>" binds a node ID to the node's X25519 identity key
+// (52 lowercase Base32 chars). First registration wins; the same key may
+// register again, a different key is refused. The answer is
+// "REG-OK-<server pub>" so the node can derive the shared node secret:
+//
+//	secret = HKDF-SHA256(X25519(server key, node key), "peyk-node:<nid>")
+//
+// Polls for a registered rid must then carry a rolling "<nonce>.<token>" with
+// token = Base32(HMAC(secret, "poll|<rid>|<window>|<nonce>"))[:16], where
+// window = Unix time / POLL_WINDOW. The server accepts the previous, current
+// and next window, and each nonce only once, so a captured poll cannot be
+// replayed to drain the rid's queue.
+
+type registryFile struct {
+	ServerKey string                    `json:"server_key"`
+	Nodes     map[string]registeredNode `json:"nodes"`
+}
+
+type registeredNode struct {
+	PublicKey    string    `json:"public_key"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// loadRegistry reads the registry, creating it with a fresh server key if missing.
+// PEYK_SERVER_KEY (hex) overrides the stored key.
+func loadRegistry(path string) error {
+	regMu.Lock()
+	defer regMu.Unlock()
+	regPath = path
+
+	var f registryFile
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &f); err != nil {
+			return err
+		}
+	}
+	if SERVER_KEY_HEX != "" {
+		f.ServerKey = SERVER_KEY_HEX
+	}
+	if f.ServerKey == "" {
+		priv, err := ecdh.X25519().GenerateKey(crand.Reader)
+		if err != nil {
+			return err
+		}
+		f.ServerKey = hex.EncodeToString(priv.Bytes())
+		log.Printf("generated new server key in %s", path)
+	}
+	raw, err := hex.DecodeString(f.ServerKey)
+	if err != nil {
+		return fmt.Errorf("server key: %v", err)
+	}
+	if serverKey, err = ecdh.X25519().NewPrivateKey(raw); err != nil {
+		return fmt.Errorf("server key: %v", err)
+	}
+	for nid, n := range f.Nodes {
+		if err := addNodeLocked(nid, n); err != nil {
+			return fmt.Errorf("node %s: %v", nid, err)
+		}
+	}
+	// Pinned allowlist entries count as registered from the start.
+	for nid, pub := range ALLOWLIST {
+		if _, ok := registry[nid]; !ok && pub != "" {
+			if err := addNodeLocked(nid, registeredNode{PublicKey: pub, RegisteredAt: time.Now()}); err != nil {
+				return fmt.Errorf("allowlist %s: %v", nid, err)
+			}
+		}
+	}
+	return saveRegistryLocked()
+}
+
+// saveRegistryLocked writes the registry atomically. regMu must be held by the caller.
+func saveRegistryLocked() error {
+	f := registryFile{
+		ServerKey: hex.EncodeToString(serverKey.Bytes()),
+		Nodes:     registry,
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := regPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, regPath)
+}
+
+// addNodeLocked stores a node and its derived secret. regMu must be held by the caller.
+func addNodeLocked(nid string, n registeredNode) error {
+	raw, err := hex.DecodeString(n.PublicKey)
+	if err != nil {
+		return err
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return err
+	}
+	shared, err := serverKey.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	secret, err := hkdf.Key(sha256.New, shared, nil, "peyk-node:"+nid, 32)
+	if err != nil {
+		return err
+	}
+	registry[nid] = n
+	nodeSecrets[nid] = secret
+	return nil
+}
+
+// nodeAllowed reports whether nid may use the server (always true without an allowlist).
+// Group IDs are always allowed; membership is checked per chunk.
+func nodeAllowed(nid string) bool {
+	if ALLOWLIST == nil {
+		return true
+	}
+	if _, ok := GROUPS[nid]; ok {
+		return true
+	}
+	if _, ok := CHANNELS[nid]; ok {
+		return true
+	}
+	_, ok := ALLOWLIST[nid]
+	return ok
+}
+
+func handleRegister(resp responseWriter, remote string, txID []byte, domain, qname string, qtype, qclass uint16) {
+	parts := strings.Split(strings.TrimSuffix(qname, "."+BASE_DOMAIN), ".")
+	if len(parts) != 4 || !isBase32ID(parts[2]) {
+		atomic.AddUint64(&statIgnored, 1)
 		return
 	}
+	nid := parts[2]
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(parts[3]))
+	if err != nil || len(raw) != 32 {
+		atomic.AddUint64(&statIgnored, 1)
+		return
+	}
+	pubHex := hex.EncodeToString(raw)
+
+	regMu.Lock()
+	status := "OK"
+	pinned, listed := ALLOWLIST[nid]
+	existing, registered := registry[nid]
+	switch {
+	case ALLOWLIST != nil && (!listed || (pinned != "" && pinned != pubHex)):
+		status = "DENY"
+	case registered && existing.PublicKey != pubHex:
+		status = "TAKEN"
+	case !registered:
+		if err := addNodeLocked(nid, registeredNode{PublicKey: pubHex, RegisteredAt: time.Now()}); err != nil {
+			status = "DENY"
+			break
+		}
+		if err := saveRegistryLocked(); err != nil {
+			log.Printf("registry save failed: %v", err)
+		}
+		logEvent("[REG]", "\x1b[32m", "registered nid=%s key=%s… from=%s", nid, pubHex[:16], remote)
+	}
+	regMu.Unlock()
+
+	if status != "OK" {
+		logEvent("[REG]", "\x1b[31m", "REJECTED nid=%s status=%s from=%s", nid, status, remote)
+		sendPollingPayload(resp, txID, domain, "REG-"+status, qtype, qclass)
+		return
+	}
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	sendPollingPayload(resp, txID, domain, "REG-OK-"+strings.ToLower(enc.EncodeToString(serverKey.PublicKey().Bytes())), qtype, qclass)
+}
+
+// pollAuthorized checks a poll's "<nonce>.<token>" against the rid's node secret
+// and burns the nonce. Unregistered rids may poll without a token unless
+// registration is required.
+func pollAuthorized(rid, nonce, token string) bool {
+	regMu.Lock()
+	defer regMu.Unlock()
+	secret, registered := nodeSecrets[rid]
+	if !registered {
+		return !REQUIRE_REGISTRATION && ALLOWLIST == nil
+	}
+	if nonce == "" || len(token) != POLL_MAC_LEN {
+		return false
+	}
+	now := pollWindow(time.Now())
+	ok := false
+	for w := now - 1; w <= now+1; w++ {
+		if hmac.Equal([]byte(pollToken(secret, rid, w, nonce)), []byte(token)) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return false
+	}
+	nonceKey := rid + "|" + nonce
+	if _, used := pollNonces[nonceKey]; used {
+		return false
+	}
+	pollNonces[nonceKey] = time.Now()
+	return true
+}
+
+func pollWindow(t time.Time) int64 {
+	return t.Unix() / int64(POLL_WINDOW/time.Second)
+}
+
+func pollToken(secret []byte, rid string, window int64, nonce string) string {
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "poll|%s|%d|%s", rid, window, nonce)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(m.Sum(nil)))[:POLL_MAC_LEN]
+}
+
+// ───────────────────────── Cover Traffic ─────────────────────────
+//
+// Registered nodes may send dummy polls and chunks to blur timing and volume.
+// Dummies are marked with an HMAC under the node secret, so only the server
+// can tell them apart; it answers them like real queries and discards them.
+//
+//	dummy chunk: mid   = coverTag(secret, <replay token>)[:len(mid)]
+//	dummy poll:  nonce = <4 random chars> + coverTag(secret, <those 4 chars>)[:4]
+
+func coverTag(secret []byte, input string) string {
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "cover|%s", input)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(m.Sum(nil)))
+}
+
+func isCoverChunk(sid, mid, replayToken string) bool {
+	if replayToken == "" {
+		return false
+	}
+	regMu.Lock()
+	secret, ok := nodeSecrets[sid]
+	regMu.Unlock()
+	if !ok {
+		return false
+	}
+	tag := coverTag(secret, replayToken)
+	return len(mid) >= 8 && len(mid) <= len(tag) && hmac.Equal([]byte(mid), []byte(tag[:len(mid)]))
+}
+
+func isCoverPoll(rid, nonce string) bool {
+	if len(nonce) != 8 {
+		return false
+	}
+	regMu.Lock()
+	secret, ok := nodeSecrets[rid]
+	regMu.Unlock()
+	if !ok {
+		return false
+	}
+	return hmac.Equal([]byte(nonce[4:]), []byte(coverTag(secret, nonce[:4])[:4]))
+}
 
-	// 2) Chunks
-	msgs, ok := messageStore[rid]
-	if !ok || len(msgs) == 0 {
+// ───────────────────────── Channels ─────────────────────────
+//
+// A channel is a one-to-many feed: publishers upload ordinary chunks with the
+// channel ID as rid, the server appends each chunk once to the channel log with
+// a sequence number, and subscribers page through it with a cursor:
+//
+//	post: <chunk label>.s<mac>[.a…][.r…]  mac = HMAC(node secret, "pub|<frame>")[:16]
+//	read: v1.chan.<cid>.<cursor>[.<nonce>] -> "CH-<seq>-<frame>[-c<crc>]" (first seq >= cursor) or NOP
+//
+// There are no ACK2s; subscribers advance their cursor to seq+1.
+
+type channelPost struct {
+	Seq   int
+	Chunk ChunkEnvelope
+}
+
+type channelLog struct {
+	Posts []channelPost // ascending Seq
+	Next  int
+}
+
+// publishTag signs a canonical chunk frame (real IDs) for a channel post.
+func publishTag(secret []byte, frame string) string {
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "pub|%s", frame)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(m.Sum(nil)))[:PUBLISH_MAC_LEN]
+}
+
+// publishAuthorized checks that sid is a publisher of cid and signed this chunk.
+func publishAuthorized(cid, sid, frame, tag string) bool {
+	listed := false
+	for _, p := range CHANNELS[cid] {
+		if p == sid {
+			listed = true
+			break
+		}
+	}
+	if !listed || tag == "" {
+		return false
+	}
+	regMu.Lock()
+	secret, ok := nodeSecrets[sid]
+	regMu.Unlock()
+	return ok && hmac.Equal([]byte(tag), []byte(publishTag(secret, frame)))
+}
+
+func handleChannelPost(resp responseWriter, remote string, txID []byte, domain, prefix string, c ChunkEnvelope, rts time.Time, qtype, qclass uint16) {
+	frame := chunkFrame(c.Idx, c.Tot, c.MID, c.SID, c.RID, c.Payload, c.Ext)
+	if !publishAuthorized(c.RID, c.SID, frame, metaToken(prefix, 's', PUBLISH_MAC_LEN)) {
+		atomic.AddUint64(&statChanAuth, 1)
+		logEvent("[CHAN]", "\x1b[31m", "REJECTED post sid=%s cid=%s %d/%d from=%s", c.SID, c.RID, c.Idx, c.Tot, remote)
+		sendAResponse(resp, txID, domain, STATUS_UNAUTHORIZED, qtype, qclass)
+		return
+	}
+
+	storeMu.Lock()
+	if markReplayLocked(c.SID, fmt.Sprintf("%s|%d", metaToken(prefix, 'r', REPLAY_TOKEN_LEN), c.Idx), rts) {
+		storeMu.Unlock()
+		atomic.AddUint64(&statRxDupChunks, 1)
+		sendAResponse(resp, txID, domain, STATUS_DUPLICATE, qtype, qclass)
+		return
+	}
+	cl := channelLogs[c.RID]
+	if cl == nil {
+		cl = &channelLog{Next: 1}
+		channelLogs[c.RID] = cl
+	}
+	for _, p := range cl.Posts {
+		if p.Chunk.SID == c.SID && p.Chunk.MID == c.MID && p.Chunk.Tot == c.Tot && p.Chunk.Idx == c.Idx {
+			storeMu.Unlock()
+			atomic.AddUint64(&statRxDupChunks, 1)
+			sendAResponse(resp, txID, domain, STATUS_DUPLICATE, qtype, qclass)
+			return
+		}
+	}
+	size := chunkBytes(c)
+	if !makeRoomLocked(c.RID, "", size, size) {
 		storeMu.Unlock()
+		atomic.AddUint64(&statQuota, 1)
+		logEvent("[QUOTA]", "\x1b[31m", "REFUSED post sid=%s cid=%s %d/%d (bytes=%d total=%d) from=%s",
+			c.SID, c.RID, c.Idx, c.Tot, ridBytes[c.RID], storeBytes, remote)
+		sendAResponse(resp, txID, domain, STATUS_QUOTA, qtype, qclass)
+		return
+	}
+	seq := cl.Next
+	cl.Next++
+	cl.Posts = append(cl.Posts, channelPost{Seq: seq, Chunk: c})
+	accountLocked(c.RID, size)
+	if len(cl.Posts) > CHANNEL_MAX_POSTS {
+		trimChannelLocked(c.RID, cl, len(cl.Posts)-CHANNEL_MAX_POSTS)
+	}
+	storeMu.Unlock()
+
+	atomic.AddUint64(&statChanPosts, 1)
+	logIf(ENABLE_RX_CHUNK_LOG, "CHAN post sid=%s cid=%s %d/%d seq=%d from=%s", c.SID, c.RID, c.Idx, c.Tot, seq, remote)
+	if c.Idx == c.Tot {
+		logEvent("[CHAN]", "\x1b[32m", "post sid=%s cid=%s mid=%s parts=%d seq=%d", c.SID, c.RID, c.MID, c.Tot, seq)
+	}
+	sendAResponse(resp, txID, domain, STATUS_STORED, qtype, qclass)
+}
+
+// trimChannelLocked drops the n oldest posts of channel cid and their bytes.
+// storeMu must be held by the caller.
+func trimChannelLocked(cid string, cl *channelLog, n int) {
+	for _, p := range cl.Posts[:n] {
+		accountLocked(cid, -chunkBytes(p.Chunk))
+	}
+	cl.Posts = cl.Posts[n:]
+}
+
+// handleChannelPoll answers a cursor read. Reads are not authenticated: posts are
+// end-to-end encrypted, and the cid alone only reveals ciphertext.
+func handleChannelPoll(resp responseWriter, remote string, txID []byte, domain, qname string, qtype, qclass uint16) {
+	labels := strings.Split(strings.TrimSuffix(qname, "."+BASE_DOMAIN), ".")
+	if len(labels) < 4 {
+		sendPollingPayload(resp, txID, domain, "NOP", qtype, qclass)
+		return
+	}
+	cid, cidOK := unblindID(strings.ToLower(labels[2]))
+	blinded := isBlindID(strings.ToLower(labels[2]))
+	cursor, err := strconv.Atoi(labels[3])
+	if _, ok := CHANNELS[cid]; !ok || !cidOK || err != nil || cursor < 0 {
+		logIf(ENABLE_POLL_LOG, "channel poll unknown cid=%s cursor=%q from=%s -> NOP", cid, labels[3], remote)
+		sendPollingPayload(resp, txID, domain, "NOP", qtype, qclass)
+		return
+	}
+
+	storeMu.Lock()
+	var (
+		p     channelPost
+		found bool
+	)
+	if cl := channelLogs[cid]; cl != nil {
+		i := sort.Search(len(cl.Posts), func(i int) bool { return cl.Posts[i].Seq >= cursor })
+		if i < len(cl.Posts) {
+			p, found = cl.Posts[i], true
+		}
+	}
+	storeMu.Unlock()
+
+	if !found {
+		sendPollingPayload(resp, txID, domain, "NOP", qtype, qclass)
+		return
+	}
+	c := p.Chunk
+	wireSID, wireRID := c.SID, c.RID
+	if blinded {
+		epoch := blindEpoch(time.Now())
+		wireSID, wireRID = blindID(BLIND_KEY, c.SID, epoch), blindID(BLIND_KEY, c.RID, epoch)
+	}
+	full := fmt.Sprintf("CH-%d-%s", p.Seq, chunkFrame(c.Idx, c.Tot, c.MID, wireSID, wireRID, c.Payload, c.Ext))
+	if c.CRC != "" {
+		full += "-c" + c.CRC
+	}
+	logIf(ENABLE_POLL_LOG, "channel poll cid=%s cursor=%d from=%s -> seq=%d %d/%d sid=%s", cid, cursor, remote, p.Seq, c.Idx, c.Tot, c.SID)
+	sendPollingPayload(resp, txID, domain, full, qtype, qclass)
+}
+
+// ───────────────────────── Fair Scheduling ─────────────────────────
+//
+// Each poll answers with one item, picked by deficit round-robin over the
+// receiver's flows: one flow per sender whose head message is in the highest
+// priority class waiting, plus the receiver's own ACK2 queue (ACK2_FLOW), which
+// counts as PRIORITY_MAX. Lower classes wait until the class above drains or
+// they age into it (see pollOrderLocked); a message whose chunks have all gone
+// out leaves its class for RESEND_HOLD, so an unACKed one can't hold it. A flow whose turn comes up gets
+// DRR_QUANTUM bytes of credit and is served while its credit covers the next
+// answer; an idle flow drops out and loses its credit. A light sender therefore
+// waits at most about one answer per other flow in its class, however much a chatty
+// sender has queued. Within a sender's flow, pollOrderLocked picks the message.
 
+const (
+	ACK2_FLOW   = "#ack2" // not a valid node ID, so it never collides with a sender
+	DRR_QUANTUM = 64      // bytes of answer per turn: about one chunk frame or ACK2
+)
+
+// fairQueue is one receiver's round-robin state: Ring holds the active flows in
+// service order, Cur indexes the flow being served and Turn names the flow that
+// has already received its quantum for the current turn.
+type fairQueue struct {
+	Ring    []string
+	Cur     int
+	Turn    string
+	Deficit map[string]int
+}
+
+// fairQueues: map[receiverID] scheduler state, guarded by storeMu
+var fairQueues = make(map[string]*fairQueue)
+
+// chunkCost is the size of the poll answer that carries c.
+func chunkCost(c ChunkEnvelope) int {
+	n := len(chunkFrame(c.Idx, c.Tot, c.MID, c.SID, c.RID, c.Payload, c.Ext))
+	if c.CRC != "" {
+		n += 2 + len(c.CRC)
+	}
+	return n
+}
+
+// pickFlowLocked chooses the flow the next poll for rid serves, given the cost of
+// each active flow's next answer. ok is false when there is nothing to serve.
+// storeMu must be held by the caller.
+func pickFlowLocked(rid string, costs map[string]int) (string, bool) {
+	if len(costs) == 0 {
+		delete(fairQueues, rid)
+		return "", false
+	}
+	q := fairQueues[rid]
+	if q == nil {
+		q = &fairQueue{Deficit: make(map[string]int)}
+		fairQueues[rid] = q
+	}
+
+	// Drop flows that went idle; the first survivor at or after Cur keeps the pointer.
+	ring := q.Ring[:0]
+	cur := -1
+	for i, f := range q.Ring {
+		if _, ok := costs[f]; !ok {
+			delete(q.Deficit, f)
+			continue
+		}
+		if cur < 0 && i >= q.Cur {
+			cur = len(ring)
+		}
+		ring = append(ring, f)
+	}
+	// New flows join at the end, in a fixed order so the schedule is deterministic.
+	var fresh []string
+	for f := range costs {
+		if _, ok := q.Deficit[f]; !ok {
+			fresh = append(fresh, f)
+		}
+	}
+	sort.Strings(fresh)
+	for _, f := range fresh {
+		q.Deficit[f] = 0
+		ring = append(ring, f)
+	}
+	if cur < 0 || cur >= len(ring) {
+		cur = 0
+	}
+	q.Ring, q.Cur = ring, cur
+
+	maxCost := 0
+	for _, c := range costs {
+		if c > maxCost {
+			maxCost = c
+		}
+	}
+	// Every full pass adds DRR_QUANTUM to each flow, so this always finds one.
+	for i := 0; i < len(q.Ring)*(maxCost/DRR_QUANTUM+2); i++ {
+		f := q.Ring[q.Cur]
+		if q.Turn != f {
+			q.Deficit[f] += DRR_QUANTUM
+			q.Turn = f
+		}
+		if q.Deficit[f] >= costs[f] {
+			q.Deficit[f] -= costs[f]
+			return f, true
+		}
+		q.Cur = (q.Cur + 1) % len(q.Ring)
+		q.Turn = ""
+	}
+	return "", false
+}
+
+// ───────────────────────── Long Polling ─────────────────────────
+//
+// Over TCP a poll may ask to be held by appending "w<seconds>":
+// "v1.sync.<rid>.<nonce>[.<token>].w<seconds>". When nothing is queued for the
+// rid, the server parks the query for up to min(seconds, LONGPOLL_MAX) and
+// answers as soon as a chunk or ACK2 for the rid is stored (notifyPollersLocked),
+// or with NOP at the deadline. The connection keeps serving other queries in the
+// meantime; the client matches answers by DNS ID. UDP polls are never held.
+
+// LONGPOLL_MAX_PER_CONN bounds the polls one TCP connection may have parked, and
+// LONGPOLL_MAX_PARKED those of all connections; past either a poll gets NOP at once.
+const (
+	LONGPOLL_MAX_PER_CONN = 4
+	LONGPOLL_MAX_PARKED   = 1024
+)
+
+// parkedPolls counts the polls currently held across all connections (atomic)
+var parkedPolls int32
+
+// pollWaiters: map[rid] wake-up channels of parked polls, guarded by storeMu
+var pollWaiters = make(map[string]map[chan struct{}]struct{})
+
+// longPollWait parses a "w<seconds>" label, capped at LONGPOLL_MAX.
+func longPollWait(label string) (time.Duration, bool) {
+	if len(label) < 2 || len(label) > 4 || label[0] != 'w' {
+		return 0, false
+	}
+	secs := atoiSafe(label[1:])
+	if secs <= 0 {
+		return 0, false
+	}
+	wait := time.Duration(secs) * time.Second
+	if wait > LONGPOLL_MAX {
+		wait = LONGPOLL_MAX
+	}
+	return wait, true
+}
+
+// waitForPollLocked registers a parked poll for rid. storeMu must be held by the caller.
+func waitForPollLocked(rid string) chan struct{} {
+	ch := make(chan struct{})
+	if pollWaiters[rid] == nil {
+		pollWaiters[rid] = make(map[chan struct{}]struct{})
+	}
+	pollWaiters[rid][ch] = struct{}{}
+	return ch
+}
+
+// cancelPollWaitLocked forgets a parked poll that timed out. storeMu must be held by the caller.
+func cancelPollWaitLocked(rid string, ch chan struct{}) {
+	if w, ok := pollWaiters[rid]; ok {
+		delete(w, ch)
+		if len(w) == 0 {
+			delete(pollWaiters, rid)
+		}
+	}
+}
+
+// notifyPollersLocked wakes every poll parked for rid. storeMu must be held by the caller.
+func notifyPollersLocked(rid string) {
+	for ch := range pollWaiters[rid] {
+		close(ch)
+	}
+	delete(pollWaiters, rid)
+}
+
+// ───────────────────────── Polling ─────────────────────────
+
+func handlePolling(resp responseWriter, remote string, txID []byte, domain, qname string, qtype, qclass uint16) {
+	parts := strings.Split(qname, ".")
+	if len(parts) < 3 {
+		logIf(ENABLE_VERBOSE_LOG, "poll malformed qname=%s from=%s -> NOP", qname, remote)
+		sendPollingPayload(resp, txID, domain, "NOP", qtype, qclass)
+		return
+	}
+	// A blinded poller gets blinded IDs back; CRCs and ACK2 MACs stay over the real IDs.
+	rid, ridOK := unblindID(strings.ToLower(parts[2]))
+	blinded := isBlindID(strings.ToLower(parts[2]))
+
+	// v1.sync.<rid>.<nonce>[.<token>][.w<seconds>]: authenticate before touching any
+	// queue (ACK2 pop, sendCursor, resend state).
+	var (
+		nonce, token string
+		hold         time.Duration
+	)
+	labels := strings.Split(strings.TrimSuffix(qname, "."+BASE_DOMAIN), ".")
+	if n := len(labels); n >= 5 {
+		if secs, ok := longPollWait(labels[n-1]); ok {
+			hold = secs
+			labels = labels[:n-1]
+		}
+	}
+	if len(labels) >= 4 {
+		nonce = labels[3]
+		if len(labels) >= 5 {
+			token = labels[4]
+		}
+	}
+	if !ridOK || !pollAuthorized(rid, nonce, token) {
+		atomic.AddUint64(&statPollAuth, 1)
+		logEvent("[POLL]", "\x1b[31m", "REJECTED unauthenticated poll rid=%s from=%s", rid, remote)
+		sendPollingPayload(resp, txID, domain, "NOP", qtype, qclass)
+		return
+	}
+	if isCoverPoll(rid, nonce) {
+		atomic.AddUint64(&statDummy, 1)
+		logIf(ENABLE_POLL_LOG, "cover poll rid=%s from=%s", rid, remote)
 		sendPollingPayload(resp, txID, domain, "NOP", qtype, qclass)
 		return
 	}
+	servePoll(resp, remote, txID, domain, rid, blinded, hold, qtype, qclass)
+}
 
+// servePoll answers an authenticated poll for rid with the next ACK2 or chunk.
+// With hold > 0 (TCP long poll) an empty queue parks the poll instead of
+// answering NOP (see Long Polling).
+func servePoll(resp responseWriter, remote string, txID []byte, domain, rid string, blinded bool, hold time.Duration, qtype, qclass uint16) {
+	// 1) Candidates: the head of the ACK2 queue, and per sender the first servable
+	// message in priority order (see pollOrderLocked). Only the top priority class
+	// competes; ACK2s count as PRIORITY_MAX.
+	storeMu.Lock()
 	now := time.Now()
-	for key, chunks := range msgs {
+	msgs := messageStore[rid]
+	costs := make(map[string]int)
+	heads := make(map[string]string)
+	top := -1
+	if acks := deliveryAcks[rid]; len(acks) > 0 {
+		costs[ACK2_FLOW] = len(acks[0])
+		top = PRIORITY_MAX
+	}
+	order, prios := pollOrderLocked(rid, msgs, now)
+	for _, key := range order {
+		if prios[key] < top {
+			break
+		}
+		chunks := msgs[key]
 		keyFull := fmt.Sprintf("%s|%s", rid, key)
 		keyParts := strings.Split(key, ":")
 		if len(keyParts) == 3 {
@@ -682,76 +2390,190 @@ func handlePolling(resp responseWriter, remote string, txID []byte, domain strin
 			}
 		}
 		state := sendStates[keyFull]
+		if !state.PassedAt.IsZero() && now.Sub(state.PassedAt) < RESEND_HOLD {
+			continue // fully sent: out of its class until the hold expires
+		}
 		if !state.LastSent.IsZero() {
 			backoff := resendBackoff(state.Count)
 			if backoff > 0 && now.Sub(state.LastSent) < backoff {
 				continue
 			}
 		}
-
-		nextIdx := sendCursor[keyFull]
-		if nextIdx <= 0 {
-			nextIdx = 1
+		sid := chunks[0].SID
+		if _, ok := heads[sid]; !ok {
+			heads[sid] = key
+			costs[sid] = chunkCost(nextChunkLocked(keyFull, chunks))
+			top = prios[key]
 		}
+	}
 
-		var c ChunkEnvelope
-		found := false
-		for _, chunk := range chunks {
-			if chunk.Idx == nextIdx {
-				c = chunk
-				found = true
-				break
-			}
-		}
-		if !found {
-			nextIdx = 1
-			for _, chunk := range chunks {
-				if chunk.Idx == nextIdx {
-					c = chunk
-					found = true
-					break
+	// 2) Fair share within the class: one flow per sender plus the ACK2 queue (see Fair Scheduling).
+	flow, ok := pickFlowLocked(rid, costs)
+	if !ok {
+		if t, isTCP := resp.(tcpResponder); isTCP && hold > 0 && t.hold() {
+			wake := waitForPollLocked(rid)
+			storeMu.Unlock()
+			atomic.AddUint64(&statHeldPolls, 1)
+			logIf(ENABLE_POLL_LOG, "poll rid=%s from=%s held for up to %s", rid, remote, hold)
+			go func() {
+				defer t.release()
+				timer := time.NewTimer(hold)
+				defer timer.Stop()
+				select {
+				case <-wake:
+				case <-timer.C:
+				case <-t.ctx.Done():
 				}
-			}
-		}
-		if !found {
-			c = chunks[0]
-		}
-		sendCursor[keyFull] = c.Idx + 1
-		if sendCursor[keyFull] > c.Tot {
-			sendCursor[keyFull] = 1
-		}
-
-		full := fmt.Sprintf("%d-%d-%s-%s-%s-%s", c.Idx, c.Tot, c.MID, c.SID, c.RID, c.Payload)
-
-		// NOTE: We no longer have TXT 255 limitation; keep a sane cap anyway to avoid huge DNS responses.
-		// 480 bytes cap keeps us safe under typical 512-byte UDP DNS while still useful.
-		if len(full) > 480 {
-			full = full[:480]
+				storeMu.Lock()
+				cancelPollWaitLocked(rid, wake)
+				storeMu.Unlock()
+				if t.ctx.Err() != nil {
+					return // connection gone: leave the queue for the next poll
+				}
+				servePoll(resp, remote, txID, domain, rid, blinded, 0, qtype, qclass)
+			}()
+			return
 		}
+		storeMu.Unlock()
+		sendPollingPayload(resp, txID, domain, "NOP", qtype, qclass)
+		return
+	}
 
-		leftInKey := len(chunks)
-		if _, ok := sendFirstAt[keyFull]; !ok {
-			sendFirstAt[keyFull] = now
+	if flow == ACK2_FLOW {
+		acks := deliveryAcks[rid]
+		ack := acks[0]
+		remaining := len(acks) - 1
+		if len(acks) == 1 {
+			delete(deliveryAcks, rid)
+		} else {
+			deliveryAcks[rid] = acks[1:]
 		}
-		state.Count++
-		state.LastSent = now
-		sendStates[keyFull] = state
 		storeMu.Unlock()
 
-		logIf(ENABLE_POLL_LOG, "poll rid=%s from=%s -> CHUNK key=%s sent=%d/%d sid=%s payloadLen=%d leftInKey=%d viaQ=%d preview=%q",
-			rid, remote, key, c.Idx, c.Tot, c.SID, len(c.Payload), leftInKey, qtype, preview(full))
+		if blinded {
+			// ACK2-<sid>-... / EXPIRED-<sid>-...: the poller is the original sender
+			kind, rest, _ := strings.Cut(ack, "-")
+			ack = kind + "-" + blindID(BLIND_KEY, rid, blindEpoch(time.Now())) + strings.TrimPrefix(rest, rid)
+		}
 
-		log.Printf("DEBUG-POLL-SEND: rid=%s, msgKey=%s, keyFull=%s", rid, key, keyFull)
-		sendPollingPayload(resp, txID, domain, full, qtype, qclass)
+		logIf(ENABLE_POLL_LOG, "poll rid=%s from=%s -> ACK2 (%s) remaining=%d viaQ=%d", rid, remote, ack, remaining, qtype)
+		logEvent("[ACK2-TX]", "\x1b[35m", "sent to rid=%s ack=%s remaining=%d viaQ=%d", rid, ack, remaining, qtype)
+		sendPollingPayload(resp, txID, domain, ack, qtype, qclass)
 		return
 	}
 
-	// should not reach
-	if len(msgs) == 0 {
-		delete(messageStore, rid)
+	// 3) Chunk of the chosen sender's head message
+	key := heads[flow]
+	chunks := msgs[key]
+	keyFull := fmt.Sprintf("%s|%s", rid, key)
+	state := sendStates[keyFull]
+	c := nextChunkLocked(keyFull, chunks)
+	sendCursor[keyFull] = c.Idx + 1
+	if sendCursor[keyFull] > c.Tot {
+		sendCursor[keyFull] = 1
+	}
+
+	wireSID, wireRID := c.SID, c.RID
+	if blinded {
+		epoch := blindEpoch(now)
+		wireSID, wireRID = blindID(BLIND_KEY, c.SID, epoch), blindID(BLIND_KEY, c.RID, epoch)
+	}
+	full := chunkFrame(c.Idx, c.Tot, c.MID, wireSID, wireRID, c.Payload, c.Ext)
+	if c.CRC != "" {
+		full += "-c" + c.CRC
 	}
+
+	// NOTE: We no longer have TXT 255 limitation; keep a sane cap anyway to avoid huge DNS responses.
+	// 480 bytes cap keeps us safe under typical 512-byte UDP DNS while still useful.
+	if len(full) > 480 {
+		full = full[:480]
+	}
+
+	leftInKey := len(chunks)
+	if _, ok := sendFirstAt[keyFull]; !ok {
+		sendFirstAt[keyFull] = now
+	}
+	state.Count++
+	state.LastSent = now
+	if nextChunkLocked(keyFull, chunks).Idx <= c.Idx {
+		state.PassedAt = now // the cursor wrapped: every held chunk has gone out
+	}
+	sendStates[keyFull] = state
 	storeMu.Unlock()
-	sendPollingPayload(resp, txID, domain, "NOP", qtype, qclass)
+
+	logIf(ENABLE_POLL_LOG, "poll rid=%s from=%s -> CHUNK key=%s sent=%d/%d sid=%s payloadLen=%d leftInKey=%d viaQ=%d preview=%q",
+		rid, remote, key, c.Idx, c.Tot, c.SID, len(c.Payload), leftInKey, qtype, preview(full))
+
+	log.Printf("DEBUG-POLL-SEND: rid=%s, msgKey=%s, keyFull=%s", rid, key, keyFull)
+	sendPollingPayload(resp, txID, domain, full, qtype, qclass)
+}
+
+// nextChunkLocked returns the chunk the send cursor points at (wrapping to chunk 1,
+// or the first stored chunk if that is missing) without moving the cursor.
+// storeMu must be held by the caller.
+func nextChunkLocked(keyFull string, chunks []ChunkEnvelope) ChunkEnvelope {
+	nextIdx := sendCursor[keyFull]
+	if nextIdx <= 0 {
+		nextIdx = 1
+	}
+	for _, chunk := range chunks {
+		if chunk.Idx == nextIdx {
+			return chunk
+		}
+	}
+	for _, chunk := range chunks {
+		if chunk.Idx == 1 {
+			return chunk
+		}
+	}
+	return chunks[0]
+}
+
+// pollOrderLocked lists rid's pending messages in the order polls should serve them,
+// with their effective priorities: highest first, then the oldest first chunk. The effective
+// priority is the "p<n>" token plus one level per PRIORITY_AGING since the message
+// arrived, capped at PRIORITY_MAX, so a steady stream of urgent messages delays
+// bulk traffic but cannot starve it. Serving a message does not reset its age.
+// storeMu must be held by the caller.
+func pollOrderLocked(rid string, msgs map[string][]ChunkEnvelope, now time.Time) ([]string, map[string]int) {
+	type pending struct {
+		key   string
+		prio  int
+		first time.Time
+	}
+	order := make([]pending, 0, len(msgs))
+	for key, chunks := range msgs {
+		if len(chunks) == 0 {
+			continue
+		}
+		first := chunks[0].AddedAt
+		for _, c := range chunks[1:] {
+			if c.AddedAt.Before(first) {
+				first = c.AddedAt
+			}
+		}
+		prio := messagePriority(chunks[0].Ext) + int(now.Sub(first)/PRIORITY_AGING)
+		if prio > PRIORITY_MAX {
+			prio = PRIORITY_MAX
+		}
+		order = append(order, pending{key: key, prio: prio, first: first})
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].prio != order[j].prio {
+			return order[i].prio > order[j].prio
+		}
+		if !order[i].first.Equal(order[j].first) {
+			return order[i].first.Before(order[j].first)
+		}
+		return order[i].key < order[j].key
+	})
+	keys := make([]string, len(order))
+	prios := make(map[string]int, len(order))
+	for i, p := range order {
+		keys[i] = p.key
+		prios[p.key] = p.prio
+	}
+	return keys, prios
 }
 
 // sendPollingPayload sends payload using AAAA if requested; otherwise A fallback.
@@ -803,40 +2625,43 @@ func garbageCollector() {
 		)
 
 		storeMu.Lock()
+		// A message expires as a whole once its first chunk is older than its TTL.
+		// The sender hears about it through its ACK2 queue, once per message even
+		// when a group message expires in several member queues.
+		notified := make(map[string]bool)
 		for rid, msgs := range messageStore {
 			for key, chunks := range msgs {
 				beforeChunks += len(chunks)
-				filtered := chunks[:0]
-				for _, c := range chunks {
-					if now.Sub(c.AddedAt) < MESSAGE_TTL {
-						filtered = append(filtered, c)
-					} else {
-						expired++
+				first := chunks[0].AddedAt
+				for _, c := range chunks[1:] {
+					if c.AddedAt.Before(first) {
+						first = c.AddedAt
 					}
 				}
-				if len(filtered) == 0 {
-					delete(msgs, key)
-					keysRemoved++
-					delete(sendCursor, fmt.Sprintf("%s|%s", rid, key))
-					delete(msgFirstAt, fmt.Sprintf("%s|%s", rid, key))
-					delete(sendFirstAt, fmt.Sprintf("%s|%s", rid, key))
-				} else {
-					msgs[key] = filtered
-					afterChunks += len(filtered)
+				if now.Sub(first) < messageTTL(chunks[0].Ext) {
+					afterChunks += len(chunks)
+					continue
+				}
+				expired += len(chunks)
+				keysRemoved++
+				c := chunks[0]
+				if !notified[key] {
+					notified[key] = true
+					queueExpiredLocked(c, key)
 				}
+				purgeMessageLocked(rid, key)
 			}
-			if len(msgs) == 0 {
-				delete(messageStore, rid)
+			if _, ok := messageStore[rid]; !ok {
 				ridsRemoved++
 			}
 		}
 		for key, ts := range msgFirstAt {
-			if now.Sub(ts) > MESSAGE_TTL {
+			if now.Sub(ts) > MAX_MESSAGE_TTL {
 				delete(msgFirstAt, key)
 			}
 		}
 		for key, ts := range sendFirstAt {
-			if now.Sub(ts) > MESSAGE_TTL {
+			if now.Sub(ts) > MAX_MESSAGE_TTL {
 				delete(sendFirstAt, key)
 			}
 		}
@@ -857,14 +2682,56 @@ func garbageCollector() {
 		for key, ts := range ack2Seen {
 			if now.Sub(ts) > ACK2_TTL {
 				delete(ack2Seen, key)
+				delete(ack2Relayed, key)
 				ack2Removed++
 			}
 		}
+		for key, c := range ack2Commits {
+			if now.Sub(c.AddedAt) > MAX_MESSAGE_TTL {
+				delete(ack2Commits, key)
+			}
+		}
+		for key, g := range groupDeliveries {
+			if now.Sub(g.AddedAt) > MAX_MESSAGE_TTL {
+				delete(groupDeliveries, key)
+			}
+		}
+		for rid := range fairQueues {
+			if len(messageStore[rid]) == 0 && len(deliveryAcks[rid]) == 0 {
+				delete(fairQueues, rid)
+			}
+		}
+		for cid, cl := range channelLogs {
+			// Posts are in arrival order; the log itself stays so Seq never goes backwards.
+			keep := 0
+			for keep < len(cl.Posts) && now.Sub(cl.Posts[keep].Chunk.AddedAt) > CHANNEL_TTL {
+				keep++
+			}
+			trimChannelLocked(cid, cl, keep)
+		}
+		for sid, tokens := range replaySeen {
+			for key, ts := range tokens {
+				if now.Sub(ts) > REPLAY_WINDOW {
+					delete(tokens, key)
+				}
+			}
+			if len(tokens) == 0 {
+				delete(replaySeen, sid)
+			}
+		}
 		storeMu.Unlock()
 
+		regMu.Lock()
+		for key, ts := range pollNonces {
+			if now.Sub(ts) > 3*POLL_WINDOW {
+				delete(pollNonces, key)
+			}
+		}
+		regMu.Unlock()
+
 		if expired > 0 || keysRemoved > 0 || ridsRemoved > 0 || ack2Removed > 0 {
-			logIf(ENABLE_GC_LOG, "GC expired=%d chunks (before=%d after=%d) keysRemoved=%d ridsRemoved=%d ack2Removed=%d ttl=%s",
-				expired, beforeChunks, afterChunks, keysRemoved, ridsRemoved, ack2Removed, MESSAGE_TTL)
+			logIf(ENABLE_GC_LOG, "GC expired=%d chunks (before=%d after=%d) keysRemoved=%d ridsRemoved=%d ack2Removed=%d maxTTL=%s",
+				expired, beforeChunks, afterChunks, keysRemoved, ridsRemoved, ack2Removed, MAX_MESSAGE_TTL)
 		}
 	}
 }
@@ -899,6 +2766,18 @@ func statsLogger() {
 
 			parseFail = atomic.LoadUint64(&statParseFail)
 			ignored   = atomic.LoadUint64(&statIgnored)
+			badCRC    = atomic.LoadUint64(&statRxBadCRC)
+			ack2Auth  = atomic.LoadUint64(&statAck2Auth)
+			replay    = atomic.LoadUint64(&statReplay)
+			pollAuth  = atomic.LoadUint64(&statPollAuth)
+			dummy     = atomic.LoadUint64(&statDummy)
+			chanPosts = atomic.LoadUint64(&statChanPosts)
+			chanAuth  = atomic.LoadUint64(&statChanAuth)
+			quota     = atomic.LoadUint64(&statQuota)
+			evicted   = atomic.LoadUint64(&statQuotaEvict)
+			statQ     = atomic.LoadUint64(&statStatQuery)
+			expiredN  = atomic.LoadUint64(&statExpired)
+			held      = atomic.LoadUint64(&statHeldPolls)
 		)
 
 		storeMu.Lock()
@@ -906,6 +2785,7 @@ func statsLogger() {
 			ridCount   = len(messageStore)
 			keyCount   = 0
 			chunkCount = 0
+			byteCount  = storeBytes
 			ackUsers   = len(deliveryAcks)
 			ackCount   = 0
 		)
@@ -920,9 +2800,9 @@ func statsLogger() {
 		}
 		storeMu.Unlock()
 
-		log.Printf("📊 STATS udp rx=%d tx=%d | tcp rx=%d tx=%d | rx=%d tx=%d polls=%d rxChunks=%d dupChunks=%d rxAck2=%d txA=%d txAAAA=%d txAPay=%d txTXT=%d parseFail=%d ignored=%d store[rids=%d keys=%d chunks=%d] acks[users=%d total=%d]",
-			rxUDP, txUDP, rxTCP, txTCP, rx, tx, polls, rxChunks, rxDupChunks, rxAck2, txA, txAAAA, txAPay, txTXT, parseFail, ignored,
-			ridCount, keyCount, chunkCount, ackUsers, ackCount)
+		log.Printf("📊 STATS udp rx=%d tx=%d | tcp rx=%d tx=%d | rx=%d tx=%d polls=%d rxChunks=%d dupChunks=%d rxAck2=%d txA=%d txAAAA=%d txAPay=%d txTXT=%d parseFail=%d ignored=%d badCRC=%d ack2Auth=%d replay=%d pollAuth=%d dummy=%d chanPosts=%d chanAuth=%d quota=%d evicted=%d stat=%d expired=%d held=%d store[rids=%d keys=%d chunks=%d bytes=%d] acks[users=%d total=%d]",
+			rxUDP, txUDP, rxTCP, txTCP, rx, tx, polls, rxChunks, rxDupChunks, rxAck2, txA, txAAAA, txAPay, txTXT, parseFail, ignored, badCRC, ack2Auth, replay, pollAuth, dummy, chanPosts, chanAuth, quota, evicted, statQ, expiredN, held,
+			ridCount, keyCount, chunkCount, byteCount, ackUsers, ackCount)
 	}
 }
 
@@ -957,6 +2837,18 @@ func statsBar() {
 
 			parseFail = atomic.LoadUint64(&statParseFail)
 			ignored   = atomic.LoadUint64(&statIgnored)
+			badCRC    = atomic.LoadUint64(&statRxBadCRC)
+			ack2Auth  = atomic.LoadUint64(&statAck2Auth)
+			replay    = atomic.LoadUint64(&statReplay)
+			pollAuth  = atomic.LoadUint64(&statPollAuth)
+			dummy     = atomic.LoadUint64(&statDummy)
+			chanPosts = atomic.LoadUint64(&statChanPosts)
+			chanAuth  = atomic.LoadUint64(&statChanAuth)
+			quota     = atomic.LoadUint64(&statQuota)
+			evicted   = atomic.LoadUint64(&statQuotaEvict)
+			statQ     = atomic.LoadUint64(&statStatQuery)
+			expiredN  = atomic.LoadUint64(&statExpired)
+			held      = atomic.LoadUint64(&statHeldPolls)
 		)
 
 		storeMu.Lock()
@@ -964,6 +2856,7 @@ func statsBar() {
 			ridCount   = len(messageStore)
 			keyCount   = 0
 			chunkCount = 0
+			byteCount  = storeBytes
 			ackUsers   = len(deliveryAcks)
 			ackCount   = 0
 		)
@@ -979,9 +2872,9 @@ func statsBar() {
 		storeMu.Unlock()
 
 		line := fmt.Sprintf(
-			"STATS udp rx=%d tx=%d | tcp rx=%d tx=%d | rx=%d tx=%d polls=%d rxChunks=%d dup=%d ack2=%d txA=%d txAAAA=%d txAPay=%d txTXT=%d parseFail=%d ignored=%d store[rids=%d keys=%d chunks=%d] acks[users=%d total=%d]",
-			rxUDP, txUDP, rxTCP, txTCP, rx, tx, polls, rxChunks, rxDupChunks, rxAck2, txA, txAAAA, txAPay, txTXT, parseFail, ignored,
-			ridCount, keyCount, chunkCount, ackUsers, ackCount,
+			"STATS udp rx=%d tx=%d | tcp rx=%d tx=%d | rx=%d tx=%d polls=%d rxChunks=%d dup=%d ack2=%d txA=%d txAAAA=%d txAPay=%d txTXT=%d parseFail=%d ignored=%d badCRC=%d ack2Auth=%d replay=%d pollAuth=%d dummy=%d chanPosts=%d chanAuth=%d quota=%d evicted=%d stat=%d expired=%d held=%d store[rids=%d keys=%d chunks=%d bytes=%d] acks[users=%d total=%d]",
+			rxUDP, txUDP, rxTCP, txTCP, rx, tx, polls, rxChunks, rxDupChunks, rxAck2, txA, txAAAA, txAPay, txTXT, parseFail, ignored, badCRC, ack2Auth, replay, pollAuth, dummy, chanPosts, chanAuth, quota, evicted, statQ, expiredN, held,
+			ridCount, keyCount, chunkCount, byteCount, ackUsers, ackCount,
 		)
 		if len(line) > 240 {
 			line = line[:240]
@@ -1022,9 +2915,24 @@ func buildBaseResponse(txID []byte, domain string, qtype, qclass uint16, ancount
 	return resp
 }
 
-// Original ACK response (single A RR)
+// sendAResponse answers with a single status RR: A for A queries, and the
+// IPv4-mapped address (::ffff:a.b.c.d) as AAAA for AAAA queries.
 func sendAResponse(resp responseWriter, txID []byte, domain, ipStr string, qtype, qclass uint16) {
 	respMsg := buildBaseResponse(txID, domain, qtype, qclass, 1)
+	if qtype == QTYPE_AAAA {
+		respMsg = append(respMsg,
+			0xc0, 0x0c, // NAME ptr
+			0x00, 0x1c, // TYPE AAAA
+			0x00, 0x01, // CLASS IN
+			0x00, 0x00, 0x00, 0x1e, // TTL 30s
+			0x00, 0x10, // RDLEN 16
+		)
+		respMsg = append(respMsg, net.ParseIP(ipStr).To16()...)
+		_ = resp.Send(respMsg)
+		atomic.AddUint64(&statTxPackets, 1)
+		atomic.AddUint64(&statTxAAAA, 1)
+		return
+	}
 	respMsg = append(respMsg,
 		0xc0, 0x0c, // NAME ptr
 		0x00, 0x01, // TYPE A
@@ -1161,8 +3069,9 @@ func packBytesToIPv4(b []byte) [][4]byte {
 
 // ───────────────────────── Utils ─────────────────────────
 
+// isBase32ID accepts legacy 5-char IDs and 8-16 char IDs.
 func isBase32ID(s string) bool {
-	if len(s) != 5 {
+	if len(s) != LEGACY_ID_LEN && (len(s) < MIN_ID_LEN || len(s) > MAX_ID_LEN) {
 		return false
 	}
 	for _, r := range s {
@@ -1175,6 +3084,222 @@ func isBase32ID(s string) bool {
 	return true
 }
 
+// isBlindID reports whether s has the shape of a pseudonym (see ID blinding).
+func isBlindID(s string) bool {
+	if len(s) != BLIND_ID_LEN || s[0] != BLIND_ID_MARK {
+		return false
+	}
+	for _, r := range s[1:] {
+		if (r < 'a' || r > 'z') && (r < '2' || r > '7') {
+			return false
+		}
+	}
+	return true
+}
+
+// isWireID accepts a node ID or a pseudonym in place of one.
+func isWireID(s string) bool {
+	return isBase32ID(s) || isBlindID(s)
+}
+
+// chunkFrame renders the canonical chunk text covered by the checksum.
+func chunkFrame(idx, tot int, mid, sid, rid, payload string, ext []string) string {
+	frame := fmt.Sprintf("%d-%d-%s-%s-%s-%s", idx, tot, mid, sid, rid, payload)
+	if len(ext) > 0 {
+		frame += "-" + strings.Join(ext, "-")
+	}
+	return frame
+}
+
+// replayBoundFrame is what an uploaded chunk's CRC covers: the frame plus its
+// replay token ("<frame>.r<token>"), so a replayer can't swap the token
+// without failing the check. Without a token it is the bare frame.
+func replayBoundFrame(frame, token string) string {
+	if token == "" {
+		return frame
+	}
+	return frame + ".r" + token
+}
+
+// chunkCRC returns the low 20 bits of CRC-32 (IEEE) as 4 Base32 chars.
+func chunkCRC(frame string) string {
+	const chars = "abcdefghijklmnopqrstuvwxyz234567"
+	sum := crc32.ChecksumIEEE([]byte(frame))
+	b := make([]byte, 4)
+	for i := 3; i >= 0; i-- {
+		b[i] = chars[sum&0x1f]
+		sum >>= 5
+	}
+	return string(b)
+}
+
+// splitChunkExt separates the trailing "c<crc>" token from other extension tokens
+// and drops "x<pad>" padding, which is not covered by the CRC and never stored.
+func splitChunkExt(tokens []string) ([]string, string) {
+	var (
+		ext []string
+		crc string
+	)
+	for i, t := range tokens {
+		t = strings.ToLower(t)
+		if i == len(tokens)-1 && len(t) == 5 && t[0] == 'c' {
+			crc = t[1:]
+			continue
+		}
+		if t != "" && t[0] == 'x' {
+			continue
+		}
+		ext = append(ext, t)
+	}
+	return ext, crc
+}
+
+// chunkVersion reads the "v<n>" protocol version token (1 if absent).
+func chunkVersion(ext []string) int {
+	for _, t := range ext {
+		if len(t) > 1 && t[0] == 'v' {
+			if v := atoiSafe(t[1:]); v > 0 {
+				return v
+			}
+		}
+	}
+	return 1
+}
+
+// messageTTL reads the "t<minutes>" TTL token, bounded by MAX_MESSAGE_TTL.
+// Without one a message lives MESSAGE_TTL (or the max, if that is lower).
+func messageTTL(ext []string) time.Duration {
+	ttl := MESSAGE_TTL
+	for _, t := range ext {
+		if len(t) > 1 && len(t) <= 7 && t[0] == 't' {
+			if m := atoiSafe(t[1:]); m > 0 {
+				ttl = time.Duration(m) * time.Minute
+			}
+		}
+	}
+	if ttl > MAX_MESSAGE_TTL {
+		ttl = MAX_MESSAGE_TTL
+	}
+	return ttl
+}
+
+// messagePriority reads the "p<n>" priority token (PRIORITY_DEFAULT if absent or out of range).
+func messagePriority(ext []string) int {
+	for _, t := range ext {
+		if len(t) == 2 && t[0] == 'p' && t[1] >= '0' && t[1]-'0' <= PRIORITY_MAX {
+			return int(t[1] - '0')
+		}
+	}
+	return PRIORITY_DEFAULT
+}
+
+func legacyIDsAllowed() bool {
+	return LEGACY_IDS_UNTIL.IsZero() || time.Now().Before(LEGACY_IDS_UNTIL)
+}
+
+// validChunkIDs applies the per-version ID rules: v1 is all 5-char IDs,
+// v2+ needs a long mid. 5-char IDs are refused once the legacy window ends.
+func validChunkIDs(version int, mid, sid, rid string) bool {
+	legacy := legacyIDsAllowed()
+	for _, id := range []string{sid, rid} {
+		if len(id) == LEGACY_ID_LEN && !legacy {
+			return false
+		}
+		if version < 2 && len(id) != LEGACY_ID_LEN {
+			return false
+		}
+	}
+	if version < 2 {
+		return len(mid) == LEGACY_ID_LEN && legacy
+	}
+	return len(mid) >= MIN_ID_LEN
+}
+
+// blindEpoch numbers the BLIND_EPOCH-long period containing t.
+func blindEpoch(t time.Time) int64 {
+	return t.Unix() / int64(BLIND_EPOCH/time.Second)
+}
+
+// blindID is the wire pseudonym of a node ID for one epoch (see ID blinding in README).
+func blindID(key []byte, id string, epoch int64) string {
+	m := hmac.New(sha256.New, key)
+	fmt.Fprintf(m, "blind|%s|%d", strings.ToLower(id), epoch)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return string(BLIND_ID_MARK) + strings.ToLower(enc.EncodeToString(m.Sum(nil)))[:BLIND_ID_LEN-1]
+}
+
+// metaToken returns the body of the "<tag><n chars>" meta label that may follow
+// a chunk or ACK2 label ("a<commit>", "r<ts><nonce>").
+func metaToken(prefix string, tag byte, n int) string {
+	labels := strings.Split(prefix, ".")
+	for _, l := range labels[1:] {
+		if len(l) == 1+n && l[0] == tag {
+			return strings.ToLower(l[1:])
+		}
+	}
+	return ""
+}
+
+// checkReplayToken parses the replay token and checks its timestamp against the window.
+// Tokenless queries pass (zero ts) unless REQUIRE_REPLAY_TOKEN is set.
+func checkReplayToken(prefix string) (time.Time, bool) {
+	tok := metaToken(prefix, 'r', REPLAY_TOKEN_LEN)
+	if tok == "" {
+		return time.Time{}, !REQUIRE_REPLAY_TOKEN
+	}
+	sec, err := strconv.ParseInt(tok[:7], 36, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ts := time.Unix(sec, 0)
+	now := time.Now()
+	if now.Sub(ts) > REPLAY_WINDOW || ts.Sub(now) > REPLAY_SKEW {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+// markReplayLocked records a token for a sender and reports whether it was already used.
+// A zero ts (tokenless query) is never tracked. storeMu must be held by the caller.
+func markReplayLocked(sid, key string, ts time.Time) bool {
+	if ts.IsZero() {
+		return false
+	}
+	if replaySeen[sid] == nil {
+		replaySeen[sid] = make(map[string]time.Time)
+	}
+	if _, ok := replaySeen[sid][key]; ok {
+		return true
+	}
+	// GC drops it once ts leaves the window, i.e. when checkReplayToken would refuse it anyway.
+	replaySeen[sid][key] = ts
+	return false
+}
+
+// requeueAck2Locked queues the ACK2 relayed for ackKey again, unless the sender
+// has yet to fetch it. STATUS_DELIVERED is unauthenticated, so a sender that lost
+// the ACK2 needs it back to stop for good. storeMu must be held by the caller.
+func requeueAck2Locked(sid, ackKey string) {
+	ack, ok := ack2Relayed[ackKey]
+	if !ok {
+		return
+	}
+	for _, a := range deliveryAcks[sid] {
+		if a == ack {
+			return
+		}
+	}
+	deliveryAcks[sid] = append(deliveryAcks[sid], ack)
+	notifyPollersLocked(sid)
+}
+
+// ack2Commitment hashes an ACK2 MAC the same way the sender did when registering it.
+func ack2Commitment(mac string) string {
+	sum := sha256.Sum256([]byte(mac))
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(sum[:]))[:ACK2_MAC_LEN]
+}
+
 func atoiSafe(s string) int {
 	n := 0
 	for _, r := range s {
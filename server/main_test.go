@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// init() in main.go needs a domain; package variables are set up before it runs.
+var _ = os.Setenv("PEYK_DOMAIN", "t.test")
+
+// captureResponder keeps every answer instead of writing it to a socket.
+type captureResponder struct {
+	answers [][]byte
+}
+
+func (c *captureResponder) Send(resp []byte) error {
+	c.answers = append(c.answers, resp)
+	return nil
+}
+
+// captureConn is a net.Conn that only counts writes.
+type captureConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes int
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes++
+	return len(b), nil
+}
+
+func (c *captureConn) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
+
+// upload sends one chunk or ACK2 query over A and returns the status IP.
+func upload(t *testing.T, prefix string) string {
+	t.Helper()
+	qname := prefix + "." + BASE_DOMAIN
+	r := &captureResponder{}
+	handleInboundOrAck2(r, "test", []byte{0, 1}, qname, qname, QTYPE_A, 1)
+	if len(r.answers) != 1 {
+		t.Fatalf("%s: got %d answers, want 1", prefix, len(r.answers))
+	}
+	a := r.answers[0]
+	return net.IP(a[len(a)-4:]).String()
+}
+
+// poll serves one poll for rid over AAAA and returns the unpacked payload.
+func poll(t *testing.T, rid string) string {
+	t.Helper()
+	r := &captureResponder{}
+	servePoll(r, "test", []byte{0, 1}, BASE_DOMAIN, rid, false, 0, QTYPE_AAAA, 1)
+	if len(r.answers) != 1 {
+		t.Fatalf("poll %s: got %d answers, want 1", rid, len(r.answers))
+	}
+	return unpackAAAA(r.answers[0])
+}
+
+// statQuery sends a sender status query over AAAA and returns the unpacked payload.
+func statQuery(t *testing.T, label string) string {
+	t.Helper()
+	qname := label + "." + BASE_DOMAIN
+	r := &captureResponder{}
+	handleInboundOrAck2(r, "test", []byte{0, 1}, qname, qname, QTYPE_AAAA, 1)
+	if len(r.answers) != 1 {
+		t.Fatalf("%s: got %d answers, want 1", label, len(r.answers))
+	}
+	return unpackAAAA(r.answers[0])
+}
+
+// unpackAAAA reverses sendAAAABytesResponse.
+func unpackAAAA(a []byte) string {
+	n := int(binary.BigEndian.Uint16(a[6:8]))
+	var payload []byte
+	for rr := a[len(a)-28*n:]; len(rr) > 0; rr = rr[28:] {
+		payload = append(payload, rr[13:28]...) // skip RR header and index byte
+	}
+	return string(bytes.TrimRight(payload, "\x00"))
+}
+
+// testMID returns a distinct valid message ID for i < 676.
+func testMID(i int) string {
+	return "midaaa" + string(rune('a'+i/26)) + string(rune('a'+i%26))
+}
+
+func queued(rid, key string) bool {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	_, ok := messageStore[rid][key]
+	return ok
+}
+
+func TestGroupAck2MemberCannotAckForAnother(t *testing.T) {
+	const (
+		gid    = "grpaaaaa"
+		sender = "membaaaa"
+		bob    = "membbbbb"
+		carol  = "membcccc"
+		mid    = "midaaaaa"
+	)
+	GROUPS = map[string][]string{gid: {sender, bob, carol}}
+	regMu.Lock()
+	nodeSecrets[bob] = []byte("bob secret")
+	nodeSecrets[carol] = []byte("carol secret")
+	regMu.Unlock()
+	t.Cleanup(func() {
+		GROUPS = nil
+		regMu.Lock()
+		delete(nodeSecrets, bob)
+		delete(nodeSecrets, carol)
+		regMu.Unlock()
+	})
+
+	if got := upload(t, "1-1-"+mid+"-"+sender+"-"+gid+"-abcd-v2"); got != STATUS_STORED {
+		t.Fatalf("chunk: got %s, want %s", got, STATUS_STORED)
+	}
+	key := sender + ":" + mid + ":1"
+	ack := "ack2-" + sender + "-1-" + mid + "-m" + bob
+
+	if got := upload(t, ack); got != STATUS_UNAUTHORIZED {
+		t.Errorf("untagged ACK2: got %s, want %s", got, STATUS_UNAUTHORIZED)
+	}
+	forged := ack2MemberTag([]byte("carol secret"), sender, 1, mid, bob)
+	if got := upload(t, ack+".u"+forged); got != STATUS_UNAUTHORIZED {
+		t.Errorf("carol acking for bob: got %s, want %s", got, STATUS_UNAUTHORIZED)
+	}
+	if !queued(bob, key) {
+		t.Fatalf("bob's copy was purged by a forged ACK2")
+	}
+
+	tag := ack2MemberTag([]byte("bob secret"), sender, 1, mid, bob)
+	if got := upload(t, ack+".u"+tag); got != STATUS_STORED {
+		t.Fatalf("bob's own ACK2: got %s, want %s", got, STATUS_STORED)
+	}
+	if queued(bob, key) {
+		t.Errorf("bob's copy still queued after his ACK2")
+	}
+	if !queued(carol, key) {
+		t.Errorf("carol's copy purged by bob's ACK2")
+	}
+}
+
+func TestFairPollServesLightSender(t *testing.T) {
+	const (
+		rid   = "rcvfaira"
+		heavy = "heavyaaa"
+		light = "lightaaa"
+	)
+	for i := 0; i < 40; i++ {
+		for idx := 1; idx <= 3; idx++ {
+			upload(t, strings.Join([]string{strconv.Itoa(idx), "3", testMID(i), heavy, rid, "aaaaaaaaaaaaaaaaaaaa", "v2"}, "-"))
+		}
+	}
+	// Let the heavy sender own the queue for a while before the light one shows up.
+	for i := 0; i < 10; i++ {
+		if got := poll(t, rid); !strings.Contains(got, heavy) {
+			t.Fatalf("poll %d: got %q, want a chunk from %s", i, got, heavy)
+		}
+	}
+	upload(t, "1-1-"+testMID(0)+"-"+light+"-"+rid+"-bbbb-v2")
+
+	const bound = 3
+	for i := 0; i < bound; i++ {
+		if got := poll(t, rid); strings.Contains(got, light) {
+			return
+		}
+	}
+	t.Fatalf("light sender not served within %d polls", bound)
+}
+
+func TestPollPriorityAcrossSenders(t *testing.T) {
+	const (
+		rid    = "rcvprioa"
+		normal = "normalaa"
+		urgent = "urgentaa"
+	)
+	for i := 0; i < 5; i++ {
+		upload(t, "1-1-"+testMID(i)+"-"+normal+"-"+rid+"-aaaa-v2")
+	}
+	for idx := 1; idx <= 3; idx++ {
+		upload(t, strconv.Itoa(idx)+"-3-"+testMID(0)+"-"+urgent+"-"+rid+"-bbbb-v2-p3")
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := poll(t, rid); !strings.Contains(got, urgent) {
+			t.Fatalf("poll %d: got %q, want the p3 chunks from %s before p1 traffic", i, got, urgent)
+		}
+	}
+	// The p3 message is fully sent but not ACKed: it must not hold the class.
+	const bound = 2
+	for i := 0; i < bound; i++ {
+		if got := poll(t, rid); strings.Contains(got, normal) {
+			return
+		}
+	}
+	t.Fatalf("p1 sender not served within %d polls of the p3 message going out", bound)
+}
+
+func TestDeliveredRequeuesAck2(t *testing.T) {
+	const (
+		sender = "sndrdela"
+		rid    = "rcvdelaa"
+		mid    = "middelaa"
+	)
+	chunk := "1-1-" + mid + "-" + sender + "-" + rid + "-abcd-v2"
+	if got := upload(t, chunk); got != STATUS_STORED {
+		t.Fatalf("chunk: got %s, want %s", got, STATUS_STORED)
+	}
+	if got := upload(t, "ack2-"+sender+"-1-"+mid); got != STATUS_STORED {
+		t.Fatalf("ACK2: got %s, want %s", got, STATUS_STORED)
+	}
+	want := "ACK2-" + sender + "-1-" + mid
+	if got := poll(t, sender); got != want {
+		t.Fatalf("sender poll: got %q, want %q", got, want)
+	}
+
+	// The sender lost that answer and uploads again: it is told DELIVERED and gets the ACK2 back once.
+	for i := 0; i < 2; i++ {
+		if got := upload(t, chunk); got != STATUS_DELIVERED {
+			t.Fatalf("re-upload %d: got %s, want %s", i, got, STATUS_DELIVERED)
+		}
+	}
+	if got := poll(t, sender); got != want {
+		t.Fatalf("sender poll after DELIVERED: got %q, want %q", got, want)
+	}
+	if got := poll(t, sender); got != "NOP" {
+		t.Errorf("ACK2 queued more than once: got %q", got)
+	}
+}
+
+func TestStatQueryReportsNoneHeld(t *testing.T) {
+	const (
+		sender = "sndrstat"
+		rid    = "rcvstata"
+		mid    = "midstata"
+	)
+	label := "stat-" + sender + "-" + mid + "-"
+	if got := statQuery(t, label+"nonceaaa."+rid+"-3"); got != "STAT-NONE" {
+		t.Fatalf("nothing stored: got %q, want STAT-NONE", got)
+	}
+	upload(t, "2-3-"+mid+"-"+sender+"-"+rid+"-abcd-v2")
+	if got := statQuery(t, label+"noncebbb."+rid+"-3"); got != "STAT-3-40" {
+		t.Fatalf("chunk 2 of 3 stored: got %q, want STAT-3-40", got)
+	}
+	if got := statQuery(t, label+"nonceccc"); got != "NOP" {
+		t.Errorf("query without rid and tot: got %q, want NOP", got)
+	}
+}
+
+func TestStatQuerySharedMID(t *testing.T) {
+	const (
+		sender = "sndrsmid"
+		bob    = "rcvsmidb"
+		carol  = "rcvsmidc"
+		mid    = "midshare"
+	)
+	upload(t, "1-2-"+mid+"-"+sender+"-"+bob+"-abcd-v2")
+	upload(t, "3-4-"+mid+"-"+sender+"-"+carol+"-abcd-v2")
+
+	label := "stat-" + sender + "-" + mid + "-"
+	if got := statQuery(t, label+"nonceaaa."+bob+"-2"); got != "STAT-2-80" {
+		t.Errorf("bob's message: got %q, want STAT-2-80", got)
+	}
+	if got := statQuery(t, label+"noncebbb."+carol+"-4"); got != "STAT-4-20" {
+		t.Errorf("carol's message: got %q, want STAT-4-20", got)
+	}
+}
+
+func TestLongPollCapAndDisconnect(t *testing.T) {
+	const rid = "rcvlongp"
+	conn := &captureConn{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := tcpResponder{conn: conn, mu: new(sync.Mutex), held: new(int32), ctx: ctx}
+
+	// Server-wide cap reached: answered at once instead of parked.
+	atomic.StoreInt32(&parkedPolls, LONGPOLL_MAX_PARKED)
+	servePoll(r, "test", []byte{0, 1}, BASE_DOMAIN, rid, false, time.Minute, QTYPE_AAAA, 1)
+	atomic.StoreInt32(&parkedPolls, 0)
+	if got := conn.count(); got != 1 {
+		t.Fatalf("poll over the cap: got %d answers, want 1", got)
+	}
+
+	servePoll(r, "test", []byte{0, 2}, BASE_DOMAIN, rid, false, time.Minute, QTYPE_AAAA, 1)
+	if got := atomic.LoadInt32(&parkedPolls); got != 1 {
+		t.Fatalf("parked polls: got %d, want 1", got)
+	}
+	cancel() // the connection's read loop exited
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&parkedPolls) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("held poll not released after the connection closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	upload(t, "1-1-midlongp-sndrlong-"+rid+"-abcd-v2")
+	time.Sleep(20 * time.Millisecond)
+	if got := conn.count(); got != 1 {
+		t.Errorf("held poll answered on a closed connection: got %d answers, want 1", got)
+	}
+	if !queued(rid, "sndrlong:midlongp:1") {
+		t.Errorf("chunk consumed by a poll whose connection is gone")
+	}
+}
+
+func TestGroupChunkReservesAllCopies(t *testing.T) {
+	const (
+		gid    = "grpquota"
+		sender = "qmembaaa"
+		mid    = "midquota"
+	)
+	GROUPS = map[string][]string{gid: {sender, "qmembbbb", "qmembccc"}}
+	limit := MAX_TOTAL_BYTES
+	t.Cleanup(func() {
+		GROUPS = nil
+		MAX_TOTAL_BYTES = limit
+	})
+
+	size := chunkBytes(ChunkEnvelope{MID: mid, SID: sender, RID: gid, Payload: "abcd", Ext: []string{"v2"}})
+	storeMu.Lock()
+	MAX_TOTAL_BYTES = storeBytes + size*3/2 // room for one copy, not for two
+	storeMu.Unlock()
+
+	if got := upload(t, "1-1-"+mid+"-"+sender+"-"+gid+"-abcd-v2"); got != STATUS_QUOTA {
+		t.Fatalf("group chunk over the global cap: got %s, want %s", got, STATUS_QUOTA)
+	}
+	key := sender + ":" + mid + ":1"
+	if queued("qmembbbb", key) || queued("qmembccc", key) {
+		t.Errorf("refused group chunk left a copy behind")
+	}
+}
+
+func TestValidChunkIDsAfterLegacyWindow(t *testing.T) {
+	until := LEGACY_IDS_UNTIL
+	t.Cleanup(func() { LEGACY_IDS_UNTIL = until })
+
+	LEGACY_IDS_UNTIL = time.Now().Add(time.Hour)
+	if !validChunkIDs(2, "midaaaaa", "sndra", "rcvra") {
+		t.Errorf("5-char IDs refused inside the legacy window")
+	}
+
+	LEGACY_IDS_UNTIL = time.Now().Add(-time.Hour)
+	if !validChunkIDs(2, "midaaaaa", "sndraaaaaa", "rcvraaaa") {
+		t.Errorf("v2 chunk with long sid and rid refused")
+	}
+	for _, ids := range [][2]string{{"sndra", "rcvraaaa"}, {"sndraaaaaa", "rcvra"}} {
+		if validChunkIDs(2, "midaaaaa", ids[0], ids[1]) {
+			t.Errorf("sid %s rid %s accepted after the legacy window", ids[0], ids[1])
+		}
+	}
+	if validChunkIDs(1, "mida1", "sndra", "rcvra") {
+		t.Errorf("v1 chunk accepted after the legacy window")
+	}
+}
+
+func TestUnknownPseudonymRefused(t *testing.T) {
+	const (
+		sender   = "sndrblnd"
+		rid      = "rcvrblnd"
+		stranger = "strangra"
+	)
+	BLIND_KEY = []byte("test blind key")
+	regMu.Lock()
+	registry[sender] = registeredNode{}
+	registry[rid] = registeredNode{}
+	regMu.Unlock()
+	t.Cleanup(func() {
+		BLIND_KEY = nil
+		regMu.Lock()
+		delete(registry, sender)
+		delete(registry, rid)
+		regMu.Unlock()
+	})
+	epoch := blindEpoch(time.Now())
+	// The CRC is over the real IDs, so a chunk to an unknown node would fail it.
+	chunk := func(mid, from, to string) string {
+		frame := chunkFrame(1, 1, mid, from, to, "abcd", []string{"v2"})
+		return chunkFrame(1, 1, mid, blindID(BLIND_KEY, from, epoch), blindID(BLIND_KEY, to, epoch), "abcd", []string{"v2"}) + "-c" + chunkCRC(frame)
+	}
+
+	if got := upload(t, chunk("midblnda", sender, rid)); got != STATUS_STORED {
+		t.Fatalf("known pseudonyms: got %s, want %s", got, STATUS_STORED)
+	}
+	if !queued(rid, sender+":midblnda:1") {
+		t.Fatalf("chunk not queued under the real rid")
+	}
+
+	if got := upload(t, chunk("midblndb", sender, stranger)); got != STATUS_UNAUTHORIZED {
+		t.Errorf("unknown rid pseudonym: got %s, want %s", got, STATUS_UNAUTHORIZED)
+	}
+	if got := upload(t, chunk("midblndc", stranger, rid)); got != STATUS_UNAUTHORIZED {
+		t.Errorf("unknown sid pseudonym: got %s, want %s", got, STATUS_UNAUTHORIZED)
+	}
+	if isBase32ID(blindID(BLIND_KEY, stranger, epoch)) {
+		t.Errorf("pseudonym %s passes for a real ID", blindID(BLIND_KEY, stranger, epoch))
+	}
+
+	r := &captureResponder{}
+	qname := "v1.sync." + blindID(BLIND_KEY, stranger, epoch) + ".nonceaaa." + BASE_DOMAIN
+	handlePolling(r, "test", []byte{0, 1}, BASE_DOMAIN, qname, QTYPE_AAAA, 1)
+	if len(r.answers) != 1 || unpackAAAA(r.answers[0]) != "NOP" {
+		t.Errorf("poll with an unknown pseudonym was served")
+	}
+}
+
+// testToken returns a fresh replay token body ("<ts><nonce>") for nonce (4 chars).
+func testToken(nonce string) string {
+	ts := strconv.FormatInt(time.Now().Unix(), 36)
+	return strings.Repeat("0", 7-len(ts)) + ts + nonce
+}
+
+func TestReplayTokenBoundToCRC(t *testing.T) {
+	const (
+		sender = "sndrrply"
+		rid    = "rcvrrply"
+	)
+	until := LEGACY_IDS_UNTIL
+	t.Cleanup(func() { LEGACY_IDS_UNTIL = until })
+	chunk := func(mid, crcToken, token string) string {
+		frame := chunkFrame(1, 1, mid, sender, rid, "abcd", []string{"v2"})
+		label := frame + "-c" + chunkCRC(replayBoundFrame(frame, crcToken))
+		if token != "" {
+			label += ".r" + token
+		}
+		return label
+	}
+
+	// Inside the legacy window a sender may still send the CRC of the bare frame.
+	LEGACY_IDS_UNTIL = time.Now().Add(time.Hour)
+	if got := upload(t, chunk("midrplya", "", testToken("aaaa"))); got != STATUS_STORED {
+		t.Fatalf("old-style CRC in the legacy window: got %s, want %s", got, STATUS_STORED)
+	}
+
+	LEGACY_IDS_UNTIL = time.Now().Add(-time.Hour)
+	tok := testToken("bbbb")
+	if got := upload(t, chunk("midrplyb", tok, tok)); got != STATUS_STORED {
+		t.Fatalf("bound token: got %s, want %s", got, STATUS_STORED)
+	}
+	if got := upload(t, chunk("midrplyb", tok, testToken("cccc"))); got != STATUS_BAD_CRC {
+		t.Errorf("swapped token: got %s, want %s", got, STATUS_BAD_CRC)
+	}
+	if got := upload(t, chunk("midrplyc", "", "")); got != STATUS_REPLAY {
+		t.Errorf("tokenless v2 chunk after the legacy window: got %s, want %s", got, STATUS_REPLAY)
+	}
+	if got := upload(t, chunk("midrplyd", "", testToken("dddd"))); got != STATUS_BAD_CRC {
+		t.Errorf("bare-frame CRC after the legacy window: got %s, want %s", got, STATUS_BAD_CRC)
+	}
+
+	// Receivers never see the token, so the relayed CRC covers the bare frame.
+	frame := chunkFrame(1, 1, "midrplya", sender, rid, "abcd", []string{"v2"})
+	if got, want := poll(t, rid), frame+"-c"+chunkCRC(frame); got != want {
+		t.Errorf("relayed chunk: got %q, want %q", got, want)
+	}
+}
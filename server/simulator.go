@@ -2,41 +2,182 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
+	"math"
+	"math/big"
+	mrand "math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	MY_ID     = "simul"
-	TARGET_ID = "a3akc"
-
 	// Direct server IP for DNS queries (bypasses recursive DNS)
 	// Set to empty string "" to use system recursive DNS instead
 	DIRECT_SERVER_PORT = 53
 
 	// Fallback to A only when enabled and no response received
 	ENABLE_A_FALLBACK = false
+
+	// Server status codes for chunk/ACK2 queries: 3.4.0.<code> (A) or ::ffff:3.4.0.<code> (AAAA)
+	STATUS_STORED       = "3.4.0.0"
+	STATUS_DUPLICATE    = "3.4.0.1"
+	STATUS_DELIVERED    = "3.4.0.2"
+	STATUS_MALFORMED    = "3.4.0.3"
+	STATUS_QUOTA        = "3.4.0.4"
+	STATUS_BAD_CRC      = "3.4.0.5"
+	STATUS_REPLAY       = "3.4.0.6"
+	STATUS_UNAUTHORIZED = "3.4.0.7"
+	// Resends of one chunk after STATUS_BAD_CRC
+	CRC_RETRIES = 2
+	// Status queries (and re-uploads of missing chunks) after some uploads got no answer
+	STAT_ROUNDS = 2
+
+	// Priority classes for the "p<n>" chunk token (the server serves higher first;
+	// PRIORITY_NORMAL is its default and sends no token)
+	PRIORITY_BULK   = 0
+	PRIORITY_NORMAL = 1
+	PRIORITY_URGENT = 3
+
+	// Append a "-c<crc>" checksum token to every outgoing chunk label
+	ENABLE_CHUNK_CRC = true
+
+	// DNS label/name budget; chunk payload is capped to match Flutter client chunk size
+	MAX_LABEL_LEN     = 63
+	MAX_QNAME_LEN     = 253
+	MAX_CHUNK_PAYLOAD = 30
+
+	// Protocol v2 ("v2" chunk token): message IDs are MID_LEN random chars,
+	// generated node IDs NODE_ID_LEN
+	PROTOCOL_VERSION = 2
+	MID_LEN          = 8
+	NODE_ID_LEN      = 10
+
+	// Reed-Solomon works over GF(256): data + parity shards must fit in 255
+	FEC_MAX_SHARDS = 255
+
+	// DEFLATE the message body before encryption when it actually shrinks
+	ENABLE_COMPRESSION = true
+
+	// Authenticate ACK2s with a MAC derived from the message (and register a commitment with the server)
+	ENABLE_ACK2_AUTH = true
+	ACK2_MAC_LEN     = 16
+
+	// Tag chunk and ACK2 queries with "r<ts><nonce>" so the server can refuse replays
+	ENABLE_REPLAY_TOKEN = true
+
+	// Register MY_ID with the server at startup and authenticate polls with the node secret
+	ENABLE_REGISTRATION = true
+	POLL_MAC_LEN        = 16
+	POLL_WINDOW         = 30 * time.Second // rolling poll token window (same as server)
+
+	// Cover traffic (needs registration): dummy polls/chunks the server discards,
+	// and a memoryless poll schedule instead of the fast/backoff pattern.
+	ENABLE_COVER_TRAFFIC = false
+	COVER_POLL_MEAN      = 1500 * time.Millisecond // mean gap between real polls
+	COVER_DUMMY_POLL     = 4 * time.Second         // mean gap between dummy polls
+	COVER_DUMMY_CHUNK    = 20 * time.Second        // mean gap between dummy chunks
+	// Pad every chunk label to MAX_LABEL_LEN with an "x<pad>" token (outside the CRC)
+	ENABLE_LABEL_PADDING = false
+
+	// Use double-ratchet sessions (key version 4) once a peer key is pinned
+	ENABLE_RATCHET = true
+	// Max message keys skipped in one chain step, and max skipped keys kept per session
+	RATCHET_MAX_SKIP    = 256
+	RATCHET_MAX_SKIPPED = 1024
+	// Upper bound for an inflated body (guards against decompression bombs)
+	MAX_PLAINTEXT_SIZE = 1 << 20
+
+	// Envelope freshness window (matches server MESSAGE_TTL) and tolerated clock skew
+	ENVELOPE_MAX_AGE  = 24 * time.Hour
+	ENVELOPE_MAX_SKEW = 5 * time.Minute
+	// Reject messages that arrive without an authenticated envelope
+	REQUIRE_ENVELOPE = false
 )
 
 var (
+	// MY_ID is our node ID: PEYK_NODE_ID, or else the one generated on first run
+	// and kept in the keystore (see loadKeystore). TARGET_ID (PEYK_TARGET_ID) is
+	// the peer plain input goes to.
+	MY_ID     string
+	TARGET_ID string
+
 	BASE_DOMAIN      string
 	PASSPHRASE       string
 	DIRECT_SERVER_IP string
+
+	// FEC_RATIO = parity chunks per data chunk (0 disables forward error correction)
+	FEC_RATIO float64
+
+	// TTL_MINUTES asks the server to drop our undelivered messages after this long
+	// ("t<minutes>" chunk token; 0 = server default). The server caps it.
+	TTL_MINUTES int
+
+	// LONGPOLL_SECONDS > 0 polls over one TCP connection to DIRECT_SERVER_IP and asks
+	// the server to hold each poll that long ("w<seconds>") instead of polling on a timer
+	LONGPOLL_SECONDS int
+
+	// Key derivation: PBKDF2-SHA256(passphrase, KDF_SALT, KDF_ITERATIONS) -> masterKey,
+	// then HKDF per conversation. SEND_KEY_VERSION picks the ciphertext format we send.
+	KDF_SALT         string
+	KDF_ITERATIONS   int
+	SEND_KEY_VERSION int
+	masterKey        []byte
+
+	// KEYSTORE_PATH holds our X25519 identity key and the contacts' public keys
+	KEYSTORE_PATH string
+
+	// SEEN_PATH persists the receive dedup store across restarts
+	SEEN_PATH string
+
+	// TRANSFERS_PATH persists outgoing file transfers for resume; DOWNLOAD_DIR receives files
+	TRANSFERS_PATH string
+	DOWNLOAD_DIR   string
+
+	// SERVER_PUBKEY pins the server's X25519 key (Base32); empty = trust on first registration
+	SERVER_PUBKEY string
+
+	// GROUPS (PEYK_GROUPS="<gid>:<m1>+<m2>+...,...", same as server): gid -> members.
+	// Group messages use the conversation key for (sender, gid).
+	GROUPS map[string][]string
+
+	// CHANNELS (PEYK_CHANNELS="<cid>:<p1>+<p2>+...,...", same as server): cid -> publishers.
+	// /sub reads a channel, /post publishes to it (publishers only).
+	CHANNELS map[string][]string
+
+	// BLIND_KEY (PEYK_BLIND_KEY) replaces node IDs on the wire with rotating pseudonyms; nil = plain IDs
+	BLIND_KEY []byte
+
+	// OBFUSCATION picks the qname disguise ("" = plain, or a labelCodecs name);
+	// obfsKey must match the server's PEYK_OBFS_KEY (default BASE_DOMAIN);
+	// obfsMaxPrefix is the longest plain prefix that always fits once disguised
+	OBFUSCATION   string
+	obfsKey       []byte
+	obfsMaxPrefix int
 )
 
 // RX buffers: key = "sid-rid-tot" -> idx->payload
@@ -45,18 +186,29 @@ var (
 	buffersMu sync.Mutex
 )
 
-// Dedup store: key = "sid:<hash>" with TTL (prevents false duplicate based on tot)
+// Dedup store: key = "sid:<hash>" with TTL (prevents false duplicate based on tot).
+// Persisted to SEEN_PATH so a restart does not reopen the door to replayed chunks;
+// the TTL outlives the envelope age limit, after which validateEnvelope refuses them.
+// Each entry keeps the ACK2 MAC so re-ACKs of duplicates stay authenticated.
 var (
-	seenMu     sync.Mutex
-	seenHashAt = make(map[string]time.Time)
-	seenTTL    = 10 * time.Minute
+	seenMu   sync.Mutex
+	seenPath string
+	seen     = make(map[string]seenEntry)
+	seenTTL  = ENVELOPE_MAX_AGE + ENVELOPE_MAX_SKEW
 )
 
+type seenEntry struct {
+	At      time.Time `json:"at"`
+	Ack2Mac string    `json:"ack2_mac,omitempty"`
+}
+
 // ✅ Peyk latency metrics (TX start → ACK2 received)
 // key = "<sid>:<tot>"  (sid is sender; for our outgoing messages sid=MY_ID)
+// txAck2Mac holds the ACK2 MAC we expect for each outgoing message (same key).
 var (
 	txMu      sync.Mutex
 	txStartAt = make(map[string]time.Time)
+	txAck2Mac = make(map[string]string)
 )
 
 // IPv4-only resolver to avoid Windows AAAA timeout (~10s)
@@ -73,7 +225,50 @@ func init() {
 
 	BASE_DOMAIN = getEnvRequired("PEYK_DOMAIN")
 	PASSPHRASE = getEnvRequired("PEYK_PASSPHRASE")
+	MY_ID = strings.ToLower(getEnvOrDefault("PEYK_NODE_ID", ""))
+	TARGET_ID = strings.ToLower(getEnvRequired("PEYK_TARGET_ID"))
+	for key, id := range map[string]string{"PEYK_NODE_ID": MY_ID, "PEYK_TARGET_ID": TARGET_ID} {
+		if id != "" && !isBase32ID(id) {
+			log.Fatalf("invalid %s=%q: want 8-16 Base32 chars", key, id)
+		}
+	}
 	DIRECT_SERVER_IP = getEnvOrDefault("PEYK_DIRECT_SERVER_IP", "")
+	FEC_RATIO = getEnvFloat("PEYK_FEC_RATIO", 0)
+	TTL_MINUTES = getEnvInt("PEYK_TTL_MINUTES", 0)
+	LONGPOLL_SECONDS = getEnvInt("PEYK_LONGPOLL_SECONDS", 0)
+	if time.Duration(TTL_MINUTES)*time.Minute > ENVELOPE_MAX_AGE {
+		log.Fatalf("invalid PEYK_TTL_MINUTES=%d: receivers reject envelopes older than %s", TTL_MINUTES, ENVELOPE_MAX_AGE)
+	}
+	KDF_SALT = getEnvOrDefault("PEYK_KDF_SALT", "peyk-d:"+BASE_DOMAIN)
+	KDF_ITERATIONS = getEnvInt("PEYK_KDF_ITERATIONS", 600000)
+	SEND_KEY_VERSION = getEnvInt("PEYK_KEY_VERSION", KEY_VERSION_KDF)
+	if SEND_KEY_VERSION != KEY_VERSION_LEGACY && SEND_KEY_VERSION != KEY_VERSION_KDF {
+		log.Fatalf("invalid PEYK_KEY_VERSION=%d: want %d or %d", SEND_KEY_VERSION, KEY_VERSION_LEGACY, KEY_VERSION_KDF)
+	}
+	masterKey = deriveMasterKey(PASSPHRASE, KDF_SALT, KDF_ITERATIONS)
+	KEYSTORE_PATH = getEnvOrDefault("PEYK_KEYSTORE", "peyk_keys.json")
+	SEEN_PATH = getEnvOrDefault("PEYK_SEEN_FILE", "peyk_seen.json")
+	TRANSFERS_PATH = getEnvOrDefault("PEYK_TRANSFERS", "peyk_transfers.json")
+	DOWNLOAD_DIR = getEnvOrDefault("PEYK_DOWNLOAD_DIR", "downloads")
+	SERVER_PUBKEY = strings.ToLower(getEnvOrDefault("PEYK_SERVER_PUBKEY", ""))
+	if v := getEnvOrDefault("PEYK_BLIND_KEY", ""); v != "" {
+		sum := sha256.Sum256([]byte("peyk-blind:" + v))
+		BLIND_KEY = sum[:]
+	}
+	GROUPS = parseIDLists("PEYK_GROUPS", getEnvOrDefault("PEYK_GROUPS", ""))
+	CHANNELS = parseIDLists("PEYK_CHANNELS", getEnvOrDefault("PEYK_CHANNELS", ""))
+	OBFUSCATION = strings.ToLower(getEnvOrDefault("PEYK_OBFUSCATION", ""))
+	if _, ok := labelCodecs[OBFUSCATION]; !ok && OBFUSCATION != "" && OBFUSCATION != "none" {
+		log.Fatalf("invalid PEYK_OBFUSCATION=%q: want none, words or cdn", OBFUSCATION)
+	}
+	obfsSum := sha256.Sum256([]byte("peyk-obfs:" + getEnvOrDefault("PEYK_OBFS_KEY", BASE_DOMAIN)))
+	obfsKey = obfsSum[:]
+	if codec, ok := labelCodecs[OBFUSCATION]; ok {
+		obfsMaxPrefix = obfsPrefixBudget(codec)
+		if obfsMaxPrefix < MAX_LABEL_LEN {
+			log.Fatalf("PEYK_DOMAIN=%s is too long for PEYK_OBFUSCATION=%s: disguised names fit only %d plain chars", BASE_DOMAIN, OBFUSCATION, obfsMaxPrefix)
+		}
+	}
 }
 
 func getEnvRequired(key string) string {
@@ -92,6 +287,30 @@ func getEnvOrDefault(key, def string) string {
 	return val
 }
 
+func getEnvFloat(key string, def float64) float64 {
+	val := getEnvOrDefault(key, "")
+	if val == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || f < 0 {
+		log.Fatalf("invalid %s=%q: want a non-negative number", key, val)
+	}
+	return f
+}
+
+func getEnvInt(key string, def int) int {
+	val := getEnvOrDefault(key, "")
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		log.Fatalf("invalid %s=%q: want a positive integer", key, val)
+	}
+	return n
+}
+
 func loadDotEnv(path string) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -122,36 +341,133 @@ func loadDotEnv(path string) {
 	}
 }
 
-func generateID() string {
+// generateID returns n random Base32 chars from crypto/rand (32 divides 256, so no bias).
+func generateID(n int) string {
 	const chars = "abcdefghijklmnopqrstuvwxyz234567"
-	b := make([]byte, 5)
-	seed := time.Now().UnixNano()
-	for i := 0; i < 5; i++ {
-		seed = (seed*1664525 + 1013904223) & 0x7fffffff
-		b[i] = chars[seed%int64(len(chars))]
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		log.Fatalf("crypto/rand: %v", err)
+	}
+	for i := range b {
+		b[i] = chars[b[i]&31]
 	}
 	return string(b)
 }
 
 func main() {
 	fmt.Println("🚀 Peyk Simulator Pro [AAAA/A Mode] Started...")
+	if err := loadKeystore(KEYSTORE_PATH); err != nil {
+		log.Fatalf("keystore %s: %v", KEYSTORE_PATH, err)
+	}
+	if MY_ID == "" {
+		MY_ID = ksNodeID
+	}
 	fmt.Printf("🆔 My ID: %s | 🎯 Target ID: %s\n", MY_ID, TARGET_ID)
 	if DIRECT_SERVER_IP != "" {
 		fmt.Printf("🌐 DIRECT mode: sending to %s:%d\n", DIRECT_SERVER_IP, DIRECT_SERVER_PORT)
 	} else {
 		fmt.Println("🌐 RECURSIVE mode: using system DNS resolver")
 	}
+	fmt.Printf("🔑 My key fingerprint: %s\n", fingerprint(myPublicKey()))
+	if err := loadSeen(SEEN_PATH); err != nil {
+		log.Fatalf("dedup store %s: %v", SEEN_PATH, err)
+	}
+	if err := loadTransfers(TRANSFERS_PATH); err != nil {
+		log.Fatalf("transfer state %s: %v", TRANSFERS_PATH, err)
+	}
+	if peerPublicKey(TARGET_ID) == nil {
+		fmt.Printf("🔑 No key for %s yet: messages use the shared passphrase until you run /kex\n", TARGET_ID)
+	}
+	if ENABLE_REGISTRATION {
+		registerNode()
+	}
 	fmt.Println("--------------------------------------------------")
 
 	go startPolling()
+	if ENABLE_COVER_TRAFFIC {
+		if currentNodeSecret() == nil {
+			fmt.Println("⚠️ Cover traffic needs registration: disabled")
+		} else {
+			go coverTraffic()
+		}
+	}
 
 	fmt.Println("💬 Type your message and press Enter to send:")
+	fmt.Println("⌨️  Commands: /reply <mid> <text>, /urgent <text>, /send-file <path>, /group <gid> <text>, /sub <cid>, /unsub <cid>, /post <cid> <text>, /kex, /keys, /forget <id>, /cover")
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		msg := scanner.Text()
-		if strings.TrimSpace(msg) != "" {
-			sendManualMessage(msg)
+		if strings.TrimSpace(msg) == "" {
+			continue
+		}
+		if strings.HasPrefix(msg, "/") {
+			handleCommand(strings.Fields(msg))
+			continue
+		}
+		sendManualMessage(msg)
+	}
+}
+
+func handleCommand(args []string) {
+	switch args[0] {
+	case "/reply":
+		if len(args) < 3 || !isBase32ID(strings.ToLower(args[1])) {
+			fmt.Println("❓ Usage: /reply <mid> <text>")
+			return
+		}
+		sendEnvelope(MSG_TYPE_TEXT, strings.ToLower(args[1]), []byte(strings.Join(args[2:], " ")))
+	case "/urgent":
+		if len(args) < 2 {
+			fmt.Println("❓ Usage: /urgent <text> (served before normal messages and files)")
+			return
+		}
+		sendEnvelopeTo(TARGET_ID, PRIORITY_URGENT, MSG_TYPE_TEXT, "", []byte(strings.Join(args[1:], " ")))
+	case "/group":
+		if len(args) < 3 || !isMyGroup(strings.ToLower(args[1])) {
+			fmt.Println("❓ Usage: /group <gid> <text> (gid from PEYK_GROUPS, must include us)")
+			return
+		}
+		sendEnvelopeTo(strings.ToLower(args[1]), PRIORITY_NORMAL, MSG_TYPE_TEXT, "", []byte(strings.Join(args[2:], " ")))
+	case "/sub", "/unsub":
+		if len(args) != 2 || !isChannel(args[1]) {
+			fmt.Printf("❓ Usage: %s <cid> (cid from PEYK_CHANNELS)\n", args[0])
+			return
+		}
+		if args[0] == "/sub" {
+			subscribe(strings.ToLower(args[1]))
+		} else {
+			unsubscribe(strings.ToLower(args[1]))
+		}
+	case "/post":
+		if len(args) < 3 || !isPublisher(args[1], MY_ID) {
+			fmt.Println("❓ Usage: /post <cid> <text> (we must be a publisher of cid in PEYK_CHANNELS)")
+			return
+		}
+		if currentNodeSecret() == nil {
+			fmt.Println("⚠️ Posting needs registration: the server checks a signature under the node secret")
+			return
+		}
+		sendEnvelopeTo(strings.ToLower(args[1]), PRIORITY_NORMAL, MSG_TYPE_TEXT, "", []byte(strings.Join(args[2:], " ")))
+	case "/send-file":
+		if len(args) != 2 {
+			fmt.Println("❓ Usage: /send-file <path> (again to resume)")
+			return
+		}
+		go sendFile(args[1], strings.ToLower(TARGET_ID))
+	case "/kex":
+		sendKeyExchange()
+	case "/keys":
+		printKeys()
+	case "/forget":
+		if len(args) != 2 {
+			fmt.Println("❓ Usage: /forget <id>")
+			return
 		}
+		forgetPeerKey(strings.ToLower(args[1]))
+	case "/cover":
+		printCoverStats()
+	default:
+		fmt.Printf("❓ Unknown command %s (try /reply, /send-file, /group, /sub, /unsub, /post, /kex, /keys, /forget, /cover)\n", args[0])
 	}
 }
 
@@ -167,20 +483,31 @@ func startPolling() {
 
 	backoff := minBackoff
 
-	for {
-		queryDomain := fmt.Sprintf("v1.sync.%s.%s.%s", MY_ID, generateID(), BASE_DOMAIN)
+	// Held polls would stand out among cover polls, which are answered at once.
+	longPoll := LONGPOLL_SECONDS > 0 && DIRECT_SERVER_IP != "" && !ENABLE_COVER_TRAFFIC
+	if LONGPOLL_SECONDS > 0 && !longPoll {
+		fmt.Println("⚠️ Long polling needs DIRECT mode and no cover traffic: polling on a timer")
+	}
 
+	for {
 		var txt string
-
-		if DIRECT_SERVER_IP != "" {
-			// Direct mode: send raw DNS query to Peyk server
-			txt = pollDirect(queryDomain)
+		startedAt := time.Now()
+		if longPoll {
+			txt = pollLong(generateID(MID_LEN))
 		} else {
-			// Recursive mode (fallback)
-			txt = pollRecursive(queryDomain)
+			txt = pollOnce(generateID(MID_LEN))
 		}
+		atomic.AddUint64(&statRealPolls, 1)
 
+		if longPoll && txt == "NOP" && time.Since(startedAt) >= time.Second {
+			// The server held the poll until its deadline: ask again right away.
+			continue
+		}
 		if txt == "" || txt == "NOP" {
+			if ENABLE_COVER_TRAFFIC {
+				time.Sleep(coverDelay(COVER_POLL_MEAN))
+				continue
+			}
 			time.Sleep(backoff)
 			backoff = time.Duration(float64(backoff) * backoffStep)
 			if backoff > maxBackoff {
@@ -194,14 +521,96 @@ func startPolling() {
 		if strings.HasPrefix(txt, "ACK2-") {
 			fmt.Println("✅ [ACK2 RECEIVED]", txt)
 			handleAck2Metric(txt)
+		} else if strings.HasPrefix(txt, "EXPIRED-") {
+			handleExpired(txt)
 		} else {
 			handleIncomingChunk(txt)
 		}
 
+		if ENABLE_COVER_TRAFFIC {
+			// Same distribution whether or not the poll returned data.
+			time.Sleep(coverDelay(COVER_POLL_MEAN))
+			continue
+		}
 		time.Sleep(fastDelay)
 	}
 }
 
+// pollOnce sends one "v1.sync" query (authenticated once registered) and returns the payload.
+func pollOnce(nonce string) string {
+	prefix := fmt.Sprintf("v1.sync.%s.%s", wireID(MY_ID), nonce)
+	if secret := currentNodeSecret(); secret != nil {
+		prefix += "." + pollToken(secret, MY_ID, time.Now(), nonce)
+	}
+	return pollQuery(queryName(prefix))
+}
+
+// tcpPollConn is the persistent connection used by pollLong (nil until first use
+// and after any error).
+var (
+	tcpPollMu   sync.Mutex
+	tcpPollConn net.Conn
+)
+
+// pollLong sends a poll the server may hold for LONGPOLL_SECONDS over the TCP
+// connection and waits for its answer. Answers to earlier polls that we gave up
+// on are skipped by DNS ID. Returns "" after any error; the next call reconnects.
+func pollLong(nonce string) string {
+	prefix := fmt.Sprintf("v1.sync.%s.%s", wireID(MY_ID), nonce)
+	if secret := currentNodeSecret(); secret != nil {
+		prefix += "." + pollToken(secret, MY_ID, time.Now(), nonce)
+	}
+	prefix += fmt.Sprintf(".w%d", LONGPOLL_SECONDS)
+	query := buildDNSQuery(queryName(prefix), 28) // AAAA
+
+	tcpPollMu.Lock()
+	defer tcpPollMu.Unlock()
+	fail := func() string {
+		if tcpPollConn != nil {
+			tcpPollConn.Close()
+			tcpPollConn = nil
+		}
+		return ""
+	}
+	if tcpPollConn == nil {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", DIRECT_SERVER_IP, DIRECT_SERVER_PORT), 1500*time.Millisecond)
+		if err != nil {
+			return ""
+		}
+		tcpPollConn = conn
+	}
+	tcpPollConn.SetDeadline(time.Now().Add(time.Duration(LONGPOLL_SECONDS)*time.Second + 5*time.Second))
+
+	frame := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(frame, uint16(len(query)))
+	if _, err := tcpPollConn.Write(append(frame, query...)); err != nil {
+		return fail()
+	}
+	lenBuf := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(tcpPollConn, lenBuf); err != nil {
+			return fail()
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(tcpPollConn, msg); err != nil {
+			return fail()
+		}
+		if len(msg) > 12 && msg[0] == query[0] && msg[1] == query[1] {
+			return extractPayloadFromDNSResponse(msg)
+		}
+	}
+}
+
+// pollQuery sends one poll-style query and returns the decoded payload.
+func pollQuery(queryDomain string) string {
+	if DIRECT_SERVER_IP != "" {
+		// Direct mode: send raw DNS query to Peyk server
+		return pollDirect(queryDomain)
+	}
+	// Recursive mode (fallback)
+	return pollRecursive(queryDomain)
+}
+
 // pollDirect sends raw DNS query directly to Peyk server
 func pollDirect(domain string) string {
 	addr := fmt.Sprintf("%s:%d", DIRECT_SERVER_IP, DIRECT_SERVER_PORT)
@@ -463,12 +872,13 @@ func extractPayloadFromIPs(ips []net.IP) string {
 	return string(buf)
 }
 
-// sendDirectDNSQuery sends a DNS query directly to the Peyk server (fire and forget)
-func sendDirectDNSQuery(domain string, qtype uint16) {
+// sendDirectDNSQuery sends one query to the Peyk server over UDP and returns the
+// status address it answered with ("" if none).
+func sendDirectDNSQuery(domain string, qtype uint16) string {
 	addr := fmt.Sprintf("%s:%d", DIRECT_SERVER_IP, DIRECT_SERVER_PORT)
 	conn, err := net.DialTimeout("udp", addr, 1500*time.Millisecond)
 	if err != nil {
-		return
+		return ""
 	}
 	defer conn.Close()
 
@@ -478,33 +888,119 @@ func sendDirectDNSQuery(domain string, qtype uint16) {
 
 	// Wait for response (to get ACK from server)
 	buf := make([]byte, 512)
-	conn.Read(buf)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return extractAckIP(buf[:n])
+}
+
+// extractAckIP returns the status address of a response: the first A record, or an
+// IPv4-mapped AAAA record as a.b.c.d.
+func extractAckIP(data []byte) string {
+	if len(data) < 12 || int(data[6])<<8|int(data[7]) == 0 {
+		return ""
+	}
+	i := 12
+	for i < len(data) && data[i] != 0 {
+		if data[i]&0xC0 == 0xC0 {
+			i++
+			break
+		}
+		i += int(data[i]) + 1
+	}
+	i += 1 + 4 // root/pointer byte + QTYPE + QCLASS
+	if i < len(data) && data[i]&0xC0 == 0xC0 {
+		i += 2
+	} else {
+		for i < len(data) && data[i] != 0 {
+			i += int(data[i]) + 1
+		}
+		i++
+	}
+	if i+10 > len(data) {
+		return ""
+	}
+	rtype := int(data[i])<<8 | int(data[i+1])
+	rdlen := int(data[i+8])<<8 | int(data[i+9])
+	if i+10+rdlen > len(data) {
+		return ""
+	}
+	ip := net.IP(data[i+10 : i+10+rdlen])
+	if (rtype != 1 || rdlen != 4) && (rtype != 28 || rdlen != 16 || ip.To4() == nil) {
+		return ""
+	}
+	return ip.To4().String()
+}
+
+// uploadQuery sends a chunk/ACK2 query and returns the server's status address.
+func uploadQuery(host string) (string, error) {
+	if DIRECT_SERVER_IP != "" {
+		// Direct mode
+		return sendDirectDNSQuery(host, 28), nil // AAAA query
+	}
+	// Recursive mode
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	ips, err := resolver4.LookupIP(ctx, "ip4", host)
+	if err != nil || len(ips) == 0 {
+		return "", err
+	}
+	return ips[0].String(), nil
 }
 
 // ✅ Parse ACK2 and compute Peyk latency if it's for our outgoing message
 func handleAck2Metric(txt string) {
-	// format: ACK2-<sid>-<tot>-<mid>
+	// format: ACK2-<sid>-<tot>-<mid>[-k<mac>][-g<n>of<m>]
 	parts := strings.Split(txt, "-")
-	if len(parts) != 4 {
+	if len(parts) < 4 || len(parts) > 6 {
 		return
 	}
 
-	sid := strings.ToLower(parts[1])
+	sid := unblindFrom(strings.ToLower(parts[1]), []string{MY_ID})
 	tot, err := strconv.Atoi(parts[2])
 	if err != nil || tot <= 0 {
 		return
 	}
 	mid := strings.ToLower(parts[3])
+	mac := ""
+	acked, members := 0, 0
+	for _, tok := range parts[4:] {
+		switch {
+		case strings.HasPrefix(tok, "k"):
+			mac = strings.ToLower(tok[1:])
+		case strings.HasPrefix(tok, "g"):
+			if _, err := fmt.Sscanf(tok, "g%dof%d", &acked, &members); err != nil {
+				acked, members = 0, 0
+			}
+		}
+	}
 
 	key := fmt.Sprintf("%s:%d:%s", sid, tot, mid)
 
 	txMu.Lock()
+	if want, ok := txAck2Mac[key]; ok && !hmac.Equal([]byte(want), []byte(mac)) {
+		txMu.Unlock()
+		fmt.Printf("🚫 FORGED ACK2 ignored sid=%s tot=%d mid=%s\n", sid, tot, mid)
+		return
+	}
 	start, ok := txStartAt[key]
 	if ok {
 		delete(txStartAt, key)
 	}
+	// Group ACK2s share one MAC; keep it until the last member has confirmed.
+	if members == 0 || acked >= members {
+		delete(txAck2Mac, key)
+	}
 	txMu.Unlock()
 
+	if members > 0 {
+		fmt.Printf("📬 mid=%s delivered to %d of %d group members\n", mid, acked, members)
+	}
+	if sid == strings.ToLower(MY_ID) {
+		handleFileAck2(tot, mid, mac)
+	}
+
 	if !ok {
 		// no start time recorded (maybe old ACK2 or collision)
 		return
@@ -514,6 +1010,37 @@ func handleAck2Metric(txt string) {
 	fmt.Printf("📊 PEYK_LATENCY sid=%s tot=%d latency=%s\n", sid, tot, lat.Round(time.Millisecond))
 }
 
+// handleExpired reports a message the server dropped before it was delivered.
+func handleExpired(txt string) {
+	// format: EXPIRED-<sid>-<tot>-<mid>[-g<n>of<m>]
+	parts := strings.Split(txt, "-")
+	if len(parts) < 4 || len(parts) > 5 {
+		return
+	}
+	sid := unblindFrom(strings.ToLower(parts[1]), []string{MY_ID})
+	tot, err := strconv.Atoi(parts[2])
+	if err != nil || tot <= 0 || sid != strings.ToLower(MY_ID) {
+		return
+	}
+	mid := strings.ToLower(parts[3])
+
+	key := fmt.Sprintf("%s:%d:%s", sid, tot, mid)
+	txMu.Lock()
+	delete(txStartAt, key)
+	delete(txAck2Mac, key)
+	txMu.Unlock()
+
+	acked, members := 0, 0
+	if len(parts) == 5 {
+		fmt.Sscanf(parts[4], "g%dof%d", &acked, &members)
+	}
+	if members > 0 {
+		fmt.Printf("⌛ mid=%s expired on the server: delivered to %d of %d group members\n", mid, acked, members)
+		return
+	}
+	fmt.Printf("⌛ mid=%s expired on the server before it was delivered\n", mid)
+}
+
 // ───────────────────────── RX CHUNKS ─────────────────────────
 
 func handleIncomingChunk(txt string) {
@@ -530,21 +1057,35 @@ func handleIncomingChunk(txt string) {
 		return
 	}
 
-	if len(parts[2]) != 5 || len(parts[3]) != 5 || len(parts[4]) != 5 {
+	if !isBase32ID(parts[2]) || !isWireID(parts[3]) || !isWireID(parts[4]) {
 		return
 	}
 	mid := strings.ToLower(parts[2])
-	senderID := strings.ToLower(parts[3])
-	receiverID := strings.ToLower(parts[4])
-	payload := strings.Join(parts[5:], "-")
+	senderID := unblindFrom(strings.ToLower(parts[3]), knownPeers())
+	receiverID := unblindFrom(strings.ToLower(parts[4]), append(append([]string{MY_ID}, myGroups()...), subscribedChannels()...))
+	payload := parts[5]
 
-	if receiverID != strings.ToLower(MY_ID) {
+	if receiverID != strings.ToLower(MY_ID) && !isMyGroup(receiverID) && !isSubscribed(receiverID) {
+		return
+	}
+	if isChannel(receiverID) && !isPublisher(receiverID, senderID) {
+		fmt.Printf("🚫 [RX] %s is not a publisher of channel %s, dropped\n", senderID, receiverID)
 		return
 	}
 	if idx <= 0 || total <= 0 || idx > total || payload == "" {
 		return
 	}
 
+	ext, crc := splitChunkExt(parts[6:])
+	if crc != "" && chunkCRC(chunkFrame(idx, total, mid, senderID, receiverID, payload, ext)) != crc {
+		fmt.Printf("❌ [RX] Chunk %d/%d from %s failed CRC, dropped\n", idx, total, senderID)
+		return
+	}
+	parity := fecParity(ext)
+	if parity >= total {
+		return
+	}
+
 	key := fmt.Sprintf("%s-%s-%d-%s", senderID, receiverID, total, mid)
 
 	buffersMu.Lock()
@@ -557,12 +1098,13 @@ func handleIncomingChunk(txt string) {
 
 	fmt.Printf("📦 [RX] Chunk %d/%d from %s (have %d/%d)\n", idx, total, senderID, got, total)
 
-	if got == total {
-		assembleAndDecrypt(key, total, senderID, mid)
+	// With FEC any (total - parity) chunks are enough to rebuild the message
+	if got >= total-parity {
+		assembleAndDecrypt(key, total, parity, senderID, receiverID, mid)
 	}
 }
 
-func assembleAndDecrypt(key string, total int, senderID string, mid string) {
+func assembleAndDecrypt(key string, total int, parity int, senderID, receiverID string, mid string) {
 	// copy out under lock
 	buffersMu.Lock()
 	chunks, ok := buffers[key]
@@ -570,22 +1112,47 @@ func assembleAndDecrypt(key string, total int, senderID string, mid string) {
 		buffersMu.Unlock()
 		return
 	}
-	for i := 1; i <= total; i++ {
-		if _, exists := chunks[i]; !exists {
+
+	var fullB32 string
+	if parity > 0 {
+		if len(chunks) < total-parity {
 			buffersMu.Unlock()
 			return
 		}
-	}
+		shards := make(map[int]string, len(chunks))
+		for i, c := range chunks {
+			shards[i] = c
+		}
+		delete(buffers, key)
+		buffersMu.Unlock()
 
-	var sb strings.Builder
-	for i := 1; i <= total; i++ {
-		sb.WriteString(chunks[i])
-	}
+		data, err := fecDecodeChunks(shards, total, parity)
+		if err != nil {
+			fmt.Printf("❌ FEC Error: %v\n", err)
+			return
+		}
+		if missing := total - len(shards); missing > 0 {
+			fmt.Printf("🧩 FEC rebuilt message from %d/%d chunks (%d missing)\n", len(shards), total, missing)
+		}
+		fullB32 = strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(data))
+	} else {
+		for i := 1; i <= total; i++ {
+			if _, exists := chunks[i]; !exists {
+				buffersMu.Unlock()
+				return
+			}
+		}
 
-	delete(buffers, key)
-	buffersMu.Unlock()
+		var sb strings.Builder
+		for i := 1; i <= total; i++ {
+			sb.WriteString(chunks[i])
+		}
+
+		delete(buffers, key)
+		buffersMu.Unlock()
 
-	fullB32 := sb.String()
+		fullB32 = sb.String()
+	}
 
 	// ✅ Dedup correctly: hash of message content (not sid:tot)
 	msgHash := sha256.Sum256([]byte(fullB32))
@@ -595,7 +1162,10 @@ func assembleAndDecrypt(key string, total int, senderID string, mid string) {
 	if isDuplicateAndMark(dupKey) {
 		fmt.Printf("🔁 DUPLICATE (content-hash) ignored %s\n", dupKey)
 		// Still ACK2 (best-effort) to help sender stop resending
-		go retryAck2Stable(senderID, total, mid)
+		seenMu.Lock()
+		ackMac := seen[dupKey].Ack2Mac
+		seenMu.Unlock()
+		go retryAck2Stable(senderID, receiverID, total, mid, ackMac)
 		return
 	}
 
@@ -606,16 +1176,66 @@ func assembleAndDecrypt(key string, total int, senderID string, mid string) {
 		return
 	}
 
-	decrypted, err := decrypt(raw)
+	plain, version, err := decrypt(raw, senderID, receiverID)
 	if err != nil {
 		fmt.Printf("❌ Decrypt Error: %v\n", err)
 		return
 	}
 
-	fmt.Printf("\n📩 NEW MESSAGE [%s]: %s\n\n", senderID, decrypted)
+	env, err := decodeEnvelope([]byte(plain))
+	if err != nil {
+		fmt.Printf("❌ Payload Error: %v\n", err)
+		return
+	}
+	if keyDowngraded(senderID, receiverID, version, env.Type) {
+		fmt.Printf("🚫 REJECTED message from %s mid=%s: sealed with key v%d but a key is pinned for %s\n", senderID, mid, version, senderID)
+		return
+	}
+	if err := validateEnvelope(env, senderID, mid); err != nil {
+		fmt.Printf("🚫 REJECTED message from %s mid=%s: %v\n", senderID, mid, err)
+		return
+	}
+
+	ackMac := ""
+	if env.Tag != nil {
+		ackMac = ack2MAC(env.Tag, senderID, total, mid)
+		seenMu.Lock()
+		if e, ok := seen[dupKey]; ok {
+			e.Ack2Mac = ackMac
+			seen[dupKey] = e
+			if err := saveSeenLocked(); err != nil {
+				fmt.Printf("⚠️ dedup store save failed: %v\n", err)
+			}
+		}
+		seenMu.Unlock()
+	}
+
+	from := senderID
+	switch {
+	case isGroup(receiverID):
+		from = senderID + " → " + receiverID
+	case isChannel(receiverID):
+		from = senderID + " → #" + receiverID
+	}
+	switch {
+	case env.Type == MSG_TYPE_KEX && receiverID != strings.ToLower(MY_ID):
+		fmt.Printf("⚠️ ignoring key exchange sent to %s by %s\n", receiverID, senderID)
+	case env.Type == MSG_TYPE_KEX:
+		handleKeyExchange(senderID, env.Body)
+	case env.Type == MSG_TYPE_FILE:
+		handleFileSegment(from, mid, env.Body)
+	case env.Version < ENVELOPE_VERSION:
+		fmt.Printf("\n📩 NEW MESSAGE [%s] ⚠️ unauthenticated: %s\n\n", from, env.Body)
+	case env.ReplyTo != "":
+		fmt.Printf("\n📩 NEW MESSAGE [%s] mid=%s sent=%s ↩ %s: %s\n\n",
+			from, mid, env.SentAt.Format("15:04:05"), env.ReplyTo, env.Body)
+	default:
+		fmt.Printf("\n📩 NEW MESSAGE [%s] mid=%s sent=%s: %s\n\n",
+			from, mid, env.SentAt.Format("15:04:05"), env.Body)
+	}
 
-	// ACK2 (stable format: ack2-sid-tot-mid)
-	go retryAck2Stable(senderID, total, mid)
+	// ACK2 (stable format: ack2-sid-tot-mid[-k<mac>][-m<member>])
+	go retryAck2Stable(senderID, receiverID, total, mid, ackMac)
 }
 
 // Dedup with TTL cleanup
@@ -625,104 +1245,383 @@ func isDuplicateAndMark(k string) bool {
 	seenMu.Lock()
 	defer seenMu.Unlock()
 
-	for kk, t := range seenHashAt {
-		if now.Sub(t) > seenTTL {
-			delete(seenHashAt, kk)
+	for kk, e := range seen {
+		if now.Sub(e.At) > seenTTL {
+			delete(seen, kk)
 		}
 	}
 
-	if t, ok := seenHashAt[k]; ok && now.Sub(t) <= seenTTL {
+	if e, ok := seen[k]; ok && now.Sub(e.At) <= seenTTL {
 		return true
 	}
 
-	seenHashAt[k] = now
+	seen[k] = seenEntry{At: now}
+	if err := saveSeenLocked(); err != nil {
+		fmt.Printf("⚠️ dedup store save failed: %v\n", err)
+	}
 	return false
 }
 
+// loadSeen reads the dedup store; a missing file starts empty.
+func loadSeen(path string) error {
+	seenMu.Lock()
+	defer seenMu.Unlock()
+	seenPath = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &seen); err != nil {
+		return err
+	}
+	if seen == nil {
+		seen = make(map[string]seenEntry)
+	}
+	return nil
+}
+
+// saveSeenLocked writes the dedup store atomically. seenMu must be held by the caller.
+func saveSeenLocked() error {
+	if seenPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	tmp := seenPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, seenPath)
+}
+
 // ───────────────────────── ACK2 (Stable) ─────────────────────────
 //
-// Send "ack2-<sid>-<tot>-<mid>.<base>" (no RID) — matches stable server.
+// Send "ack2-<sid>-<tot>-<mid>[-k<mac>].<base>" (no RID) — matches stable server.
 // Retry a few times (best-effort) because DNS can drop.
+//
+// The MAC key is derived from the envelope tag, which only sender and receiver
+// ever see (it is inside the ciphertext), so neither the server nor an
+// observer who knows sid/tot/mid can forge a delivery confirmation. The sender
+// registers SHA-256(mac) with the server as an "a<commit>" label on chunk 1 so
+// the server can refuse forged ACK2s before purging the message.
+
+func ack2MAC(secret []byte, sid string, tot int, mid string) string {
+	key, err := hkdf.Key(sha256.New, secret, nil, "peyk-ack2", 32)
+	if err != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "ack2:%s:%d:%s", strings.ToLower(sid), tot, mid)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(mac.Sum(nil)))[:ACK2_MAC_LEN]
+}
 
-func retryAck2Stable(senderID string, total int, mid string) {
-	domain := fmt.Sprintf("ack2-%s-%d-%s.%s.%s", strings.ToLower(senderID), total, mid, generateID(), BASE_DOMAIN)
+// ack2Commitment is what the server stores for a message; it can check a MAC but not produce one.
+func ack2Commitment(mac string) string {
+	sum := sha256.Sum256([]byte(mac))
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(sum[:]))[:ACK2_MAC_LEN]
+}
 
-	for i := 0; i < 3; i++ {
-		if DIRECT_SERVER_IP != "" {
-			sendDirectDNSQuery(domain, 28) // AAAA query
-		} else {
-			ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
-			_, _ = resolver4.LookupIP(ctx, "ip4", domain)
-			cancel()
+// ack2MemberTag signs a group ACK2 for one member under its node secret (same as server).
+func ack2MemberTag(secret []byte, sid string, tot int, mid, member string) string {
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "ack2m|%s|%d|%s|%s", sid, tot, mid, member)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(m.Sum(nil)))[:ACK2_MAC_LEN]
+}
+
+func retryAck2Stable(senderID, receiverID string, total int, mid string, ackMac string) {
+	if isChannel(receiverID) {
+		return // broadcasts are fire-and-forget; the server keeps them until CHANNEL_TTL
+	}
+	label := fmt.Sprintf("ack2-%s-%d-%s", wireID(senderID), total, mid)
+	if ackMac != "" {
+		label += "-k" + ackMac
+	}
+	// The replay token doubles as the cache-buster; retries reuse it and the server treats them as one.
+	nonce := generateID(MID_LEN)
+	if ENABLE_REPLAY_TOKEN {
+		nonce = replayToken()
+	}
+	// Group messages are acknowledged per member; the server counts us off and relays n-of-m.
+	// All members share ackMac, so the member is proven by a tag under our node secret.
+	if isGroup(receiverID) {
+		label += "-m" + wireID(MY_ID)
+		if secret := currentNodeSecret(); secret != nil {
+			nonce += ".u" + ack2MemberTag(secret, strings.ToLower(senderID), total, mid, strings.ToLower(MY_ID))
+		}
+	}
+	domain := queryName(label + "." + nonce)
+
+	// Retry only while the server hasn't answered; any status settles it.
+	status := ""
+	for i := 0; i < 3 && status == ""; i++ {
+		status, _ = uploadQuery(domain)
+		if status == "" {
+			time.Sleep(350 * time.Millisecond)
 		}
-		time.Sleep(350 * time.Millisecond)
 	}
 
-	fmt.Printf("ACK2 sent for %s/%d mid=%s (stable)\n", senderID, total, mid)
+	switch status {
+	case STATUS_STORED, STATUS_DUPLICATE, "":
+		fmt.Printf("ACK2 sent for %s/%d mid=%s (stable)\n", senderID, total, mid)
+	default:
+		fmt.Printf("⚠️ ACK2 for %s/%d mid=%s refused by server (status %s)\n", senderID, total, mid, status)
+	}
 }
 
 // ───────────────────────── TX (Send) ─────────────────────────
 
 func sendManualMessage(msg string) {
-	hash := sha256.Sum256([]byte(PASSPHRASE))
-	key := hash[:]
-
-	block, _ := aes.NewCipher(key)
-	aesgcm, _ := cipher.NewGCM(block)
-
-	nonce := make([]byte, 12)
-	_, _ = io.ReadFull(rand.Reader, nonce)
-
-	encrypted := aesgcm.Seal(nil, nonce, []byte(msg), nil)
-	fullData := append(nonce, encrypted...)
-
-	encoded := strings.ToLower(
-		base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(fullData),
-	)
+	sendEnvelope(MSG_TYPE_TEXT, "", []byte(msg))
+}
 
-	sendChunks(encoded)
+// sendEnvelope wraps body in an authenticated envelope, encrypts it and uploads the chunks.
+func sendEnvelope(msgType byte, replyTo string, body []byte) {
+	sendEnvelopeTo(TARGET_ID, PRIORITY_NORMAL, msgType, replyTo, body)
 }
 
-func sendChunks(data string) {
-	chunkSize := 30 // Match Flutter client chunk size
-	total := (len(data) + chunkSize - 1) / chunkSize
-	mid := generateID()
+// sendEnvelopeTo sends to a node or a group ID; the server fans group messages out.
+func sendEnvelopeTo(rid string, prio int, msgType byte, replyTo string, body []byte) {
+	rid = strings.ToLower(rid)
+	mid := generateID(MID_LEN)
+	data, ackSecret := sealEnvelope(rid, mid, msgType, replyTo, body)
+	sendEncrypted(rid, mid, data, ackSecret, prio, false)
+}
 
-	// ✅ record Peyk TX start time for latency metric
-	// key is "<MY_ID>:<tot>:<mid>", matching server ACK2 format: ACK2-<sid>-<tot>-<mid>
+// sealEnvelope builds and encrypts one message for rid. It returns the ciphertext and
+// the ACK2 secret (nil for channels); sending it twice gives byte-identical chunks.
+func sealEnvelope(rid, mid string, msgType byte, replyTo string, body []byte) ([]byte, []byte) {
+	env := msgEnvelope{
+		Type:     msgType,
+		SenderID: strings.ToLower(MY_ID),
+		MsgID:    mid,
+		ReplyTo:  replyTo,
+		SentAt:   time.Now(),
+		Body:     body,
+	}
+	// Key exchange must stay readable without a pair key, so it uses the conversation key.
+	// Groups and channels have no pair key: every reader decrypts with the (sender, gid/cid) conversation key.
+	version := SEND_KEY_VERSION
+	if msgType != MSG_TYPE_KEX && !isGroup(rid) && !isChannel(rid) && peerPublicKey(rid) != nil {
+		version = KEY_VERSION_PAIR
+		if ENABLE_RATCHET && ratchetCanSend(rid) {
+			version = KEY_VERSION_RATCHET
+		}
+	}
+	plain := encodeEnvelope(env, ENABLE_COMPRESSION)
+	ackSecret := plain[len(plain)-ENVELOPE_TAG_LEN:]
+	if isChannel(rid) {
+		ackSecret = nil // nobody ACK2s a broadcast
+	}
+	return encrypt(plain, strings.ToLower(MY_ID), rid, version), ackSecret
+}
+
+// sendEncrypted splits ciphertext into chunk payloads (with FEC parity if enabled) and sends them.
+// ackSecret (may be nil) keys the ACK2 MAC we expect back; prio sets the server's
+// serving order (PRIORITY_*). resume re-sends an earlier upload of the same
+// ciphertext (see sendChunks). Returns the status of the last chunk.
+func sendEncrypted(rid, mid string, fullData []byte, ackSecret []byte, prio int, resume bool) string {
+	ext := []string{fmt.Sprintf("v%d", PROTOCOL_VERSION)}
+	if TTL_MINUTES > 0 && !isChannel(rid) {
+		ext = append(ext, fmt.Sprintf("t%d", TTL_MINUTES))
+	}
+	if prio != PRIORITY_NORMAL && !isChannel(rid) {
+		ext = append(ext, fmt.Sprintf("p%d", prio))
+	}
+
+	if FEC_RATIO > 0 {
+		budget := append(ext, "f999") // worst case, for label budget only
+		if payloads, parity := fecEncodeChunks(fullData, chunkRoom(rid, mid, budget)); parity > 0 {
+			return sendChunks(rid, mid, payloads, append(ext, fmt.Sprintf("f%d", parity)), ackSecret, resume)
+		}
+	}
+
+	encoded := strings.ToLower(
+		base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(fullData),
+	)
+
+	chunkSize := chunkRoom(rid, mid, ext)
+	var payloads []string
+	for start := 0; start < len(encoded); start += chunkSize {
+		end := start + chunkSize
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		payloads = append(payloads, encoded[start:end])
+	}
+
+	return sendChunks(rid, mid, payloads, ext, ackSecret, resume)
+}
+
+// chunkRoom returns how many payload chars fit in one label next to the header and ext tokens.
+func chunkRoom(rid, mid string, ext []string) int {
+	room := chunkLabelMax(rid) - len(chunkFrame(999, 999, mid, wireID(MY_ID), wireID(rid), "", ext))
+	if ENABLE_CHUNK_CRC {
+		room -= len("-c0000")
+	}
+	if ENABLE_LABEL_PADDING {
+		room -= len("-x")
+	}
+	if room > MAX_CHUNK_PAYLOAD {
+		room = MAX_CHUNK_PAYLOAD
+	}
+	return room
+}
+
+// chunkLabelMax is the longest chunk label to rid: MAX_LABEL_LEN, or less when the
+// label and its meta labels (".s<tag>", ".a<commit>", ".r<token>") must fit the
+// obfuscation budget together.
+func chunkLabelMax(rid string) int {
+	if obfsMaxPrefix == 0 {
+		return MAX_LABEL_LEN
+	}
+	meta := 0
+	if ENABLE_ACK2_AUTH {
+		meta += len(".a") + ACK2_MAC_LEN
+	}
+	if isChannel(rid) {
+		meta += len(".s") + PUBLISH_MAC_LEN
+	}
+	if ENABLE_REPLAY_TOKEN {
+		meta += len("." + replayToken())
+	}
+	return min(MAX_LABEL_LEN, obfsMaxPrefix-meta)
+}
+
+// sendChunks uploads the chunks in order and returns the last status seen; it
+// stops early on any status other than stored or duplicate. With resume it first
+// asks the server which chunks it still lacks and uploads only those.
+func sendChunks(rid, mid string, payloads []string, ext []string, ackSecret []byte, resume bool) string {
+	total := len(payloads)
+
+	// ✅ record Peyk TX start time for latency metric
+	// key is "<MY_ID>:<tot>:<mid>", matching server ACK2 format: ACK2-<sid>-<tot>-<mid>
 	txKey := fmt.Sprintf("%s:%d:%s", strings.ToLower(MY_ID), total, mid)
+	commitLabel := ""
 	txMu.Lock()
-	txStartAt[txKey] = time.Now()
+	if !isChannel(rid) {
+		txStartAt[txKey] = time.Now()
+	}
+	if ENABLE_ACK2_AUTH && ackSecret != nil {
+		mac := ack2MAC(ackSecret, MY_ID, total, mid)
+		txAck2Mac[txKey] = mac
+		commitLabel = "a" + ack2Commitment(mac)
+	}
 	txMu.Unlock()
 
+	// Channel posts are signed per chunk so the server can enforce the publisher list.
+	var pubSecret []byte
+	if isChannel(rid) {
+		pubSecret = currentNodeSecret()
+	}
+
 	const (
 		fastPace = 200 * time.Millisecond
 		slowPace = 900 * time.Millisecond
 	)
 
-	for i := 0; i < total; i++ {
-		start := i * chunkSize
-		end := start + chunkSize
-		if end > len(data) {
-			end = len(data)
+	// upload sends chunk i, resending it with a fresh replay token if the server's CRC check fails.
+	upload := func(i int) (string, error) {
+		meta := ""
+		if pubSecret != nil {
+			frame := chunkFrame(i+1, total, mid, strings.ToLower(MY_ID), strings.ToLower(rid), payloads[i], ext)
+			meta += ".s" + publishTag(pubSecret, frame)
+		}
+		if i == 0 && commitLabel != "" {
+			meta += "." + commitLabel
+		}
+		var (
+			status string
+			err    error
+		)
+		for try := 0; try <= CRC_RETRIES; try++ {
+			// A fresh replay token per try, or the server would answer a resend as a duplicate.
+			token := ""
+			if ENABLE_REPLAY_TOKEN {
+				token = replayToken()
+			}
+			name := chunkLabel(rid, i+1, total, mid, payloads[i], ext, token) + meta
+			if token != "" {
+				name += "." + token
+			}
+			status, err = uploadQuery(queryName(name))
+			if status != STATUS_BAD_CRC {
+				break
+			}
+			fmt.Printf("🔁 [TX] Chunk %d/%d failed the server CRC check, resending\n", i+1, total)
+		}
+		return status, err
+	}
+
+	// refused reports a status that makes the rest of this message wasted.
+	refused := func(i int, status string) bool {
+		switch status {
+		case STATUS_DELIVERED:
+			fmt.Printf("✅ [TX] mid=%s was already delivered, not sending the rest\n", mid)
+		case STATUS_QUOTA:
+			fmt.Printf("🚫 [TX] Chunk %d/%d refused: server store quota is full, mid=%s not sent\n", i+1, total, mid)
+		case STATUS_UNAUTHORIZED:
+			fmt.Printf("🚫 [TX] Chunk %d/%d refused: not authorized (allowlist, group or channel), mid=%s not sent\n", i+1, total, mid)
+		case STATUS_REPLAY:
+			fmt.Printf("🚫 [TX] Chunk %d/%d refused: replay token out of window, check the clock, mid=%s not sent\n", i+1, total, mid)
+		case STATUS_MALFORMED, STATUS_BAD_CRC:
+			fmt.Printf("🚫 [TX] Chunk %d/%d refused (status %s), mid=%s not sent\n", i+1, total, status, mid)
+		default:
+			return false
 		}
+		return true
+	}
 
-		label := fmt.Sprintf("%d-%d-%s-%s-%s-%s", i+1, total, mid, MY_ID, TARGET_ID, data[start:end])
-		host := label + "." + BASE_DOMAIN
+	todo := make([]int, total)
+	for i := range todo {
+		todo[i] = i
+	}
+	if resume && !isChannel(rid) {
+		missing, delivered, ok := missingChunks(rid, mid, total)
+		switch {
+		case !ok:
+			fmt.Printf("⚠️ [TX] Status query for mid=%s got no answer, re-sending all %d chunks\n", mid, total)
+		case delivered:
+			fmt.Printf("✅ [TX] mid=%s was already delivered\n", mid)
+			return STATUS_DELIVERED
+		default:
+			fmt.Printf("🔁 [TX] Resuming mid=%s: server is missing %d/%d chunks\n", mid, len(missing), total)
+			todo = todo[:0]
+			for _, i := range missing {
+				if i < total {
+					todo = append(todo, i)
+				}
+			}
+		}
+	}
 
+	status := ""
+	unanswered := 0
+	for _, i := range todo {
 		startTime := time.Now()
-		var err error
+		st, err := upload(i)
+		rtt := time.Since(startTime)
+		status = st
 
-		if DIRECT_SERVER_IP != "" {
-			// Direct mode
-			sendDirectDNSQuery(host, 28) // AAAA query
-		} else {
-			// Recursive mode
-			ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
-			_, err = resolver4.LookupIP(ctx, "ip4", host)
-			cancel()
+		if refused(i, status) {
+			return status
+		}
+		if status == STATUS_DUPLICATE {
+			fmt.Printf("📤 [TX] Chunk %d/%d - already on the server (RTT: %v)\n", i+1, total, rtt.Round(time.Millisecond))
+			time.Sleep(fastPace)
+			continue
+		}
+		if status == "" {
+			unanswered++
 		}
-		rtt := time.Since(startTime)
 
 		if err != nil {
 			fmt.Printf("⚠️ [TX] Chunk %d/%d - SENT (err after %v)\n", i+1, total, rtt.Round(time.Millisecond))
@@ -733,25 +1632,2222 @@ func sendChunks(data string) {
 		}
 	}
 
+	// Some uploads went unanswered: ask the server which chunks it holds and
+	// re-upload only the missing ones. Channel posts have no per-message store.
+	for round := 0; unanswered > 0 && !isChannel(rid) && round < STAT_ROUNDS; round++ {
+		missing, delivered, ok := missingChunks(rid, mid, total)
+		switch {
+		case !ok:
+			fmt.Printf("⚠️ [TX] Status query for mid=%s got no answer\n", mid)
+			unanswered = 0
+			continue
+		case delivered:
+			fmt.Printf("✅ [TX] mid=%s was already delivered\n", mid)
+			return STATUS_DELIVERED
+		case len(missing) == 0:
+			fmt.Printf("✅ [TX] Server holds all %d chunks of mid=%s\n", total, mid)
+			unanswered = 0
+			continue
+		}
+		fmt.Printf("🔁 [TX] Server is missing %d/%d chunks of mid=%s, re-uploading them\n", len(missing), total, mid)
+		unanswered = 0
+		for _, i := range missing {
+			if i >= total {
+				continue
+			}
+			st, err := upload(i)
+			if refused(i, st) {
+				return st
+			}
+			if st == "" {
+				unanswered++
+			}
+			fmt.Printf("📤 [TX] Chunk %d/%d - RESENT (err=%v)\n", i+1, total, err)
+			time.Sleep(fastPace)
+		}
+	}
+
+	atomic.AddUint64(&statRealChunks, uint64(total))
 	fmt.Println("✅ Message SENT.")
+	return status
 }
 
-// ───────────────────────── Crypto ─────────────────────────
+// missingChunks asks the server which of the total chunks of our message mid to
+// rid it holds ("stat-<sid>-<mid>-<nonce>[-<token>].<rid>-<tot>") and returns the
+// 0-based indexes of the missing ones. ok is false when the server gave no usable answer.
+func missingChunks(rid, mid string, total int) (missing []int, delivered, ok bool) {
+	nonce := generateID(MID_LEN)
+	label := fmt.Sprintf("stat-%s-%s-%s", wireID(MY_ID), mid, nonce)
+	if secret := currentNodeSecret(); secret != nil {
+		label += "-" + pollToken(secret, MY_ID, time.Now(), nonce)
+	}
+	label += fmt.Sprintf(".%s-%d", wireID(rid), total)
+	return parseStatAnswer(strings.TrimSpace(pollQuery(queryName(label))), total)
+}
 
-func decrypt(data []byte) (string, error) {
-	hash := sha256.Sum256([]byte(PASSPHRASE))
-	key := hash[:]
+// parseStatAnswer decodes a status answer for a message of total chunks.
+// STAT-NONE means the server holds none of them, so all are missing.
+func parseStatAnswer(txt string, total int) (missing []int, delivered, ok bool) {
+	switch txt {
+	case "STAT-DELIVERED":
+		return nil, true, true
+	case "STAT-NONE":
+		for i := 0; i < total; i++ {
+			missing = append(missing, i)
+		}
+		return missing, false, true
+	}
+	parts := strings.Split(txt, "-")
+	if len(parts) != 3 || parts[0] != "STAT" {
+		return nil, false, false
+	}
+	tot, err := strconv.Atoi(parts[1])
+	bitmap, herr := hex.DecodeString(parts[2])
+	if err != nil || herr != nil || tot <= 0 || len(bitmap) != (tot+7)/8 {
+		return nil, false, false
+	}
+	for i := 0; i < tot; i++ {
+		if bitmap[i/8]&(0x80>>uint(i%8)) == 0 {
+			missing = append(missing, i)
+		}
+	}
+	return missing, false, true
+}
 
-	block, _ := aes.NewCipher(key)
-	aesgcm, _ := cipher.NewGCM(block)
+// ───────────────────────── Label Obfuscation ─────────────────────────
+//
+// The qname prefix (everything before BASE_DOMAIN) can be disguised so chunk,
+// ACK2, poll and registration queries don't look machine-generated:
+//
+//  1. pack:  chars [a-z0-9-.] -> base-38 integer -> bytes (saves ~1/3)
+//  2. seal:  nonce[2] | packed XOR HMAC keystream | tag[3], keyed by OBFS_KEY
+//  3. codec: bytes -> innocuous labels ("words": pronounceable syllables,
+//     "cdn": hash-like labels plus an edge/static decoy label)
+//
+// The nonce makes every query look different; the tag tells the server a
+// disguised prefix from a plain one. Codecs are pluggable via labelCodecs.
+// Disguise costs length, so chunkLabelMax keeps chunks within obfsMaxPrefix.
+
+const OBFS_ALPHABET = "abcdefghijklmnopqrstuvwxyz0123456789-."
+
+// labelCodec maps sealed bytes to a qname prefix and back. MaxLen is the longest
+// prefix Encode can return for n bytes.
+type labelCodec interface {
+	Encode(data []byte) string
+	Decode(prefix string) ([]byte, bool)
+	MaxLen(n int) int
+}
 
-	if len(data) < 12+16 {
-		return "", fmt.Errorf("data too short")
+var labelCodecs = map[string]labelCodec{
+	"words": wordsCodec{},
+	"cdn":   cdnCodec{},
+}
+
+// obfsKeystream XORs data with HMAC(key, "obfs|" + nonce + block counter).
+func obfsKeystream(key, nonce, data []byte) []byte {
+	out := make([]byte, len(data))
+	for i := 0; i < len(data); i += sha256.Size {
+		m := hmac.New(sha256.New, key)
+		m.Write([]byte("obfs|"))
+		m.Write(nonce)
+		m.Write([]byte{byte(i / sha256.Size)})
+		block := m.Sum(nil)
+		for j := i; j < len(data) && j-i < len(block); j++ {
+			out[j] = data[j] ^ block[j-i]
+		}
 	}
+	return out
+}
 
-	nonce := data[:12]
-	ciphertext := data[12:]
+func obfsTag(key, nonce, ct []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("obfs-tag|"))
+	m.Write(nonce)
+	m.Write(ct)
+	return m.Sum(nil)[:3]
+}
+
+// obfsSeal packs a plain prefix and seals it under key with a fresh nonce.
+func obfsSeal(key []byte, prefix string) ([]byte, bool) {
+	n := big.NewInt(1)
+	radix := big.NewInt(int64(len(OBFS_ALPHABET)))
+	for i := 0; i < len(prefix); i++ {
+		d := strings.IndexByte(OBFS_ALPHABET, prefix[i])
+		if d < 0 {
+			return nil, false
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	nonce := make([]byte, 2)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, false
+	}
+	ct := obfsKeystream(key, nonce, n.Bytes())
+	return append(append(nonce, ct...), obfsTag(key, nonce, ct)...), true
+}
+
+// obfsMaxSealed is the most bytes obfsSeal returns for an n-char prefix.
+func obfsMaxSealed(n int) int {
+	max := new(big.Int).Exp(big.NewInt(int64(len(OBFS_ALPHABET))), big.NewInt(int64(n)), nil)
+	max.Lsh(max, 1).Sub(max, big.NewInt(1)) // leading 1, then n digits
+	return 2 + len(max.Bytes()) + 3
+}
+
+// obfsPrefixBudget returns the longest plain prefix whose disguise always fits in
+// a DNS name next to BASE_DOMAIN. chunkRoom sizes chunks to stay within it.
+func obfsPrefixBudget(codec labelCodec) int {
+	room := MAX_QNAME_LEN - len(BASE_DOMAIN) - 1
+	n := 0
+	for codec.MaxLen(obfsMaxSealed(n+1)) <= room {
+		n++
+	}
+	return n
+}
+
+// queryName disguises prefix with the OBFUSCATION codec and appends BASE_DOMAIN.
+// Chunks are sized to fit (see obfsPrefixBudget); any other prefix that would not
+// fit once disguised goes out plain, with a warning.
+func queryName(prefix string) string {
+	if codec, ok := labelCodecs[OBFUSCATION]; ok {
+		if sealed, ok := obfsSeal(obfsKey, strings.ToLower(prefix)); ok {
+			if name := codec.Encode(sealed) + "." + BASE_DOMAIN; len(name) <= MAX_QNAME_LEN {
+				return name
+			}
+		}
+		fmt.Printf("⚠️ %d-char query name can't be disguised with %s (limit %d), sending it plain\n", len(prefix), OBFUSCATION, obfsMaxPrefix)
+	}
+	return prefix + "." + BASE_DOMAIN
+}
+
+// bytesToDigits/digitsToBytes convert with a 0x01 sentinel so leading zero bytes survive.
+func bytesToDigits(data []byte, radix int) []int {
+	n := new(big.Int).SetBytes(append([]byte{1}, data...))
+	r := big.NewInt(int64(radix))
+	var digits []int
+	for n.Sign() > 0 {
+		var d big.Int
+		n.DivMod(n, r, &d)
+		digits = append(digits, int(d.Int64()))
+	}
+	return digits
+}
+
+func digitsToBytes(digits []int, radix int) ([]byte, bool) {
+	n := new(big.Int)
+	r := big.NewInt(int64(radix))
+	for i := len(digits) - 1; i >= 0; i-- {
+		n.Mul(n, r)
+		n.Add(n, big.NewInt(int64(digits[i])))
+	}
+	b := n.Bytes()
+	if len(b) == 0 || b[0] != 1 {
+		return nil, false
+	}
+	return b[1:], true
+}
+
+// wordsCodec: base-100 digits as consonant+vowel syllables, 3-6 syllables per label.
+type wordsCodec struct{}
+
+const (
+	wordsConsonants = "bcdfghjklmnprstvwxyz"
+	wordsVowels     = "aeiou"
+)
+
+func (wordsCodec) Encode(data []byte) string {
+	var (
+		sb   strings.Builder
+		word int
+		size = 3 + mrand.Intn(4)
+	)
+	for _, d := range bytesToDigits(data, len(wordsConsonants)*len(wordsVowels)) {
+		if word == size {
+			sb.WriteByte('.')
+			word, size = 0, 3+mrand.Intn(4)
+		}
+		sb.WriteByte(wordsConsonants[d/len(wordsVowels)])
+		sb.WriteByte(wordsVowels[d%len(wordsVowels)])
+		word++
+	}
+	return sb.String()
+}
+
+// MaxLen assumes 3-syllable labels throughout, which need the most dots.
+func (wordsCodec) MaxLen(n int) int {
+	d := len(bytesToDigits(bytes.Repeat([]byte{0xff}, n), len(wordsConsonants)*len(wordsVowels)))
+	return 2*d + (d-1)/3
+}
+
+func (wordsCodec) Decode(prefix string) ([]byte, bool) {
+	s := strings.ReplaceAll(prefix, ".", "")
+	if len(s)%2 != 0 {
+		return nil, false
+	}
+	digits := make([]int, 0, len(s)/2)
+	for i := 0; i < len(s); i += 2 {
+		c := strings.IndexByte(wordsConsonants, s[i])
+		v := strings.IndexByte(wordsVowels, s[i+1])
+		if c < 0 || v < 0 {
+			return nil, false
+		}
+		digits = append(digits, c*len(wordsVowels)+v)
+	}
+	return digitsToBytes(digits, len(wordsConsonants)*len(wordsVowels))
+}
+
+// cdnCodec: base-36 labels of 12-16 chars followed by one decoy label, like
+// "d4f8k2m1q9z0x3.e12ab7c0pq9w.edge". The decoy is always dropped on decode.
+type cdnCodec struct{}
+
+var cdnDecoys = []string{"edge", "cdn", "static", "assets", "img", "media", "s3", "cache"}
+
+func (cdnCodec) Encode(data []byte) string {
+	digits := bytesToDigits(data, 36)
+	var (
+		labels []string
+		cur    []byte
+		size   = 12 + mrand.Intn(5)
+	)
+	for _, d := range digits {
+		if len(cur) == size {
+			labels = append(labels, string(cur))
+			cur, size = nil, 12+mrand.Intn(5)
+		}
+		cur = append(cur, "0123456789abcdefghijklmnopqrstuvwxyz"[d])
+	}
+	labels = append(labels, string(cur), cdnDecoys[mrand.Intn(len(cdnDecoys))])
+	return strings.Join(labels, ".")
+}
+
+// MaxLen assumes 12-char labels throughout and the longest decoy.
+func (cdnCodec) MaxLen(n int) int {
+	d := len(bytesToDigits(bytes.Repeat([]byte{0xff}, n), 36))
+	decoy := 0
+	for _, s := range cdnDecoys {
+		decoy = max(decoy, len(s))
+	}
+	return d + (d-1)/12 + 1 + decoy
+}
+
+func (cdnCodec) Decode(prefix string) ([]byte, bool) {
+	dot := strings.LastIndexByte(prefix, '.')
+	if dot < 0 {
+		return nil, false
+	}
+	s := strings.ReplaceAll(prefix[:dot], ".", "")
+	digits := make([]int, len(s))
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte("0123456789abcdefghijklmnopqrstuvwxyz", s[i])
+		if d < 0 {
+			return nil, false
+		}
+		digits[i] = d
+	}
+	return digitsToBytes(digits, 36)
+}
+
+// ───────────────────────── Chunk Framing ─────────────────────────
+
+// chunkLabel builds the outgoing label: frame, optional "x<pad>" filling the label
+// to MAX_LABEL_LEN, then the "c<crc>" token computed over the frame without padding.
+// With ID blinding the label carries pseudonyms but the CRC still covers the real IDs.
+// token is the "r<ts><nonce>" meta label sent with it ("" for none); the CRC covers
+// "<frame>.<token>" so a replayer can't swap it (same as server replayBoundFrame).
+func chunkLabel(rid string, idx, total int, mid, payload string, ext []string, token string) string {
+	label := chunkFrame(idx, total, mid, wireID(MY_ID), wireID(rid), payload, ext)
+	crc := ""
+	if ENABLE_CHUNK_CRC {
+		bound := chunkFrame(idx, total, mid, strings.ToLower(MY_ID), strings.ToLower(rid), payload, ext)
+		if token != "" {
+			bound += "." + token
+		}
+		crc = "-c" + chunkCRC(bound)
+	}
+	if ENABLE_LABEL_PADDING {
+		if n := chunkLabelMax(rid) - len(label) - len(crc) - len("-x"); n >= 0 {
+			label += "-x" + generateID(n)
+		}
+	}
+	return label + crc
+}
+
+// isBase32ID reports whether s is a lowercase Base32 node/message ID:
+// legacy 5 chars or 8-16 chars (same as server).
+func isBase32ID(s string) bool {
+	if len(s) != 5 && (len(s) < 8 || len(s) > 16) {
+		return false
+	}
+	for _, r := range s {
+		if r < 'a' || r > 'z' {
+			if r < '2' || r > '7' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// chunkFrame renders the canonical chunk text covered by the checksum.
+func chunkFrame(idx, tot int, mid, sid, rid, payload string, ext []string) string {
+	frame := fmt.Sprintf("%d-%d-%s-%s-%s-%s", idx, tot, mid, sid, rid, payload)
+	if len(ext) > 0 {
+		frame += "-" + strings.Join(ext, "-")
+	}
+	return frame
+}
+
+// chunkCRC returns the low 20 bits of CRC-32 (IEEE) as 4 Base32 chars (same as server).
+func chunkCRC(frame string) string {
+	const chars = "abcdefghijklmnopqrstuvwxyz234567"
+	sum := crc32.ChecksumIEEE([]byte(frame))
+	b := make([]byte, 4)
+	for i := 3; i >= 0; i-- {
+		b[i] = chars[sum&0x1f]
+		sum >>= 5
+	}
+	return string(b)
+}
+
+// splitChunkExt separates the trailing "c<crc>" token from other extension tokens.
+func splitChunkExt(tokens []string) ([]string, string) {
+	var (
+		ext []string
+		crc string
+	)
+	for i, t := range tokens {
+		t = strings.ToLower(t)
+		if i == len(tokens)-1 && len(t) == 5 && t[0] == 'c' {
+			crc = t[1:]
+			continue
+		}
+		if t != "" && t[0] == 'x' {
+			continue // padding, outside the CRC
+		}
+		ext = append(ext, t)
+	}
+	return ext, crc
+}
+
+// replayToken returns the "r<ts><nonce>" meta label: send time in Unix seconds
+// (7 base36 chars) plus a random 4-char nonce. The server only accepts each
+// token once per sender and only while ts is inside its replay window.
+func replayToken() string {
+	ts := strconv.FormatInt(time.Now().Unix(), 36)
+	return "r" + strings.Repeat("0", 7-len(ts)) + ts + generateID(4)
+}
+
+// ───────────────────────── ID Blinding ─────────────────────────
+//
+// With PEYK_BLIND_KEY set, sid/rid in chunk labels, the sid in ACK2s and the rid
+// in polls are rotating pseudonyms, so a resolver operator can't build the
+// social graph from query names. The server maps them back from its registry
+// and allowlist; we map them back by trying the IDs we know.
+
+// Pseudonyms start with "0", outside the Base32 alphabet, so they never pass for a real ID.
+const (
+	BLIND_ID_MARK = '0'
+	BLIND_ID_LEN  = 9
+	BLIND_EPOCH   = time.Hour
+)
+
+// blindEpoch numbers the BLIND_EPOCH-long period containing t.
+func blindEpoch(t time.Time) int64 {
+	return t.Unix() / int64(BLIND_EPOCH/time.Second)
+}
+
+// blindID is the wire pseudonym of a node ID for one epoch (same as server).
+func blindID(key []byte, id string, epoch int64) string {
+	m := hmac.New(sha256.New, key)
+	fmt.Fprintf(m, "blind|%s|%d", strings.ToLower(id), epoch)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return string(BLIND_ID_MARK) + strings.ToLower(enc.EncodeToString(m.Sum(nil)))[:BLIND_ID_LEN-1]
+}
+
+// wireID is what goes on the wire for id: its current pseudonym, or id itself without a blind key.
+func wireID(id string) string {
+	if BLIND_KEY == nil {
+		return strings.ToLower(id)
+	}
+	return blindID(BLIND_KEY, id, blindEpoch(time.Now()))
+}
+
+// isBlindID reports whether s has the shape of a pseudonym (same as server).
+func isBlindID(s string) bool {
+	if len(s) != BLIND_ID_LEN || s[0] != BLIND_ID_MARK {
+		return false
+	}
+	for _, r := range s[1:] {
+		if (r < 'a' || r > 'z') && (r < '2' || r > '7') {
+			return false
+		}
+	}
+	return true
+}
+
+// isWireID accepts a node ID or a pseudonym in place of one.
+func isWireID(s string) bool {
+	return isBase32ID(s) || isBlindID(s)
+}
+
+// unblindFrom returns the candidate whose pseudonym (previous, current or next
+// epoch) is id; plain or unknown IDs come back unchanged.
+func unblindFrom(id string, candidates []string) string {
+	if BLIND_KEY == nil || !isBlindID(id) {
+		return id
+	}
+	epoch := blindEpoch(time.Now())
+	for _, c := range candidates {
+		for e := epoch - 1; e <= epoch+1; e++ {
+			if blindID(BLIND_KEY, c, e) == id {
+				return strings.ToLower(c)
+			}
+		}
+	}
+	return id
+}
+
+// knownPeers lists the IDs a blinded sender may be: our target, pinned contacts,
+// group members and the publishers of channels we read.
+func knownPeers() []string {
+	ksMu.Lock()
+	defer ksMu.Unlock()
+	peers := []string{strings.ToLower(TARGET_ID)}
+	for id := range ksContacts {
+		peers = append(peers, id)
+	}
+	for _, gid := range myGroups() {
+		peers = append(peers, GROUPS[gid]...)
+	}
+	for _, cid := range subscribedChannels() {
+		peers = append(peers, CHANNELS[cid]...)
+	}
+	return peers
+}
+
+// ───────────────────────── Groups ─────────────────────────
+//
+// A group ID is addressed like a node ID; the server stores one copy of each
+// chunk per member (except the sender) and counts member ACK2s, relaying
+// "-g<n>of<m>" so the sender sees partial delivery.
+
+// parseIDLists reads "<id>:<n1>+<n2>+...,..." from env var name (same as server).
+func parseIDLists(name, v string) map[string][]string {
+	if v == "" {
+		return nil
+	}
+	lists := make(map[string][]string)
+	for _, entry := range strings.Split(v, ",") {
+		id, list, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		id = strings.ToLower(id)
+		if !ok || !isBase32ID(id) {
+			log.Fatalf("invalid %s entry %q: want <id>:<n1>+<n2>+...", name, entry)
+		}
+		for _, n := range strings.Split(list, "+") {
+			n = strings.ToLower(strings.TrimSpace(n))
+			if !isBase32ID(n) {
+				log.Fatalf("invalid node ID %q in %s entry %s", n, name, id)
+			}
+			lists[id] = append(lists[id], n)
+		}
+	}
+	return lists
+}
+
+func isGroup(id string) bool {
+	_, ok := GROUPS[strings.ToLower(id)]
+	return ok
+}
+
+func isMyGroup(id string) bool {
+	for _, m := range GROUPS[strings.ToLower(id)] {
+		if m == strings.ToLower(MY_ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// myGroups lists the groups we are a member of.
+func myGroups() []string {
+	var out []string
+	for gid := range GROUPS {
+		if isMyGroup(gid) {
+			out = append(out, gid)
+		}
+	}
+	return out
+}
+
+// ───────────────────────── Channels ─────────────────────────
+//
+// One-to-many feeds (same as server): posts are ordinary chunks with the
+// channel ID as rid plus a "s<mac>" publisher signature label; the server keeps
+// one copy and each subscriber reads "v1.chan.<cid>.<cursor>.<nonce>", getting
+// back "CH-<seq>-<frame>" and moving its cursor to seq+1. No ACK2s.
+
+const (
+	PUBLISH_MAC_LEN    = 16
+	CHANNEL_POLL_EVERY = 3 * time.Second
+	CHANNEL_POLL_FAST  = 350 * time.Millisecond
+)
+
+var (
+	subsMu  sync.Mutex
+	subs    = make(map[string]int) // cid -> generation of its poller
+	subsGen int
+)
+
+func isChannel(id string) bool {
+	_, ok := CHANNELS[strings.ToLower(id)]
+	return ok
+}
+
+func isPublisher(cid, nid string) bool {
+	for _, p := range CHANNELS[strings.ToLower(cid)] {
+		if p == strings.ToLower(nid) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSubscribed(cid string) bool {
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	_, ok := subs[strings.ToLower(cid)]
+	return ok
+}
+
+// pollerCurrent reports whether the poller started as gen still owns cid's
+// subscription; after /unsub and /sub a newer poller takes over.
+func pollerCurrent(cid string, gen int) bool {
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	return subs[cid] == gen
+}
+
+func subscribedChannels() []string {
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	var out []string
+	for cid := range subs {
+		out = append(out, cid)
+	}
+	return out
+}
+
+// publishTag signs a canonical chunk frame (real IDs) for a channel post (same as server).
+func publishTag(secret []byte, frame string) string {
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "pub|%s", frame)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(m.Sum(nil)))[:PUBLISH_MAC_LEN]
+}
 
-	plain, err := aesgcm.Open(nil, nonce, ciphertext, nil)
-	return string(plain), err
+func subscribe(cid string) {
+	subsMu.Lock()
+	_, already := subs[cid]
+	if !already {
+		subsGen++
+		subs[cid] = subsGen
+	}
+	gen := subsGen
+	subsMu.Unlock()
+	if already {
+		fmt.Printf("📡 Already subscribed to %s\n", cid)
+		return
+	}
+	fmt.Printf("📡 Subscribed to channel %s\n", cid)
+	go channelPoller(cid, gen)
+}
+
+func unsubscribe(cid string) {
+	subsMu.Lock()
+	delete(subs, cid)
+	subsMu.Unlock()
+	fmt.Printf("📡 Unsubscribed from channel %s\n", cid)
+}
+
+// channelPoller reads a channel from the start of the server's backlog until unsubscribed
+// (or superseded by a later subscription, see pollerCurrent). The dedup store hides
+// posts we already showed before a restart.
+func channelPoller(cid string, gen int) {
+	cursor := 0
+	for pollerCurrent(cid, gen) {
+		prefix := fmt.Sprintf("v1.chan.%s.%d.%s", wireID(cid), cursor, generateID(MID_LEN))
+		txt := pollQuery(queryName(prefix))
+
+		rest, ok := strings.CutPrefix(txt, "CH-")
+		seqStr, frame, ok2 := strings.Cut(rest, "-")
+		seq, err := strconv.Atoi(seqStr)
+		if !ok || !ok2 || err != nil || seq < cursor {
+			time.Sleep(CHANNEL_POLL_EVERY)
+			continue
+		}
+		cursor = seq + 1
+		handleIncomingChunk(frame)
+		time.Sleep(CHANNEL_POLL_FAST)
+	}
+}
+
+// ───────────────────────── File Transfer ─────────────────────────
+//
+// /send-file splits a file into FILE_SEGMENT_SIZE segments, each sent as its own
+// MSG_TYPE_FILE message with a mid derived from (content hash, rid, segment), so
+// every segment is tracked and ACK2'd on its own. Segment body:
+//
+//	sha256[32] | seg u16 | count u16 | size u32 | len+name | data
+//
+// Segments are sealed as they enter the window and persisted in TRANSFERS_PATH
+// before their first upload. A resumed transfer asks the server which chunks of
+// a sealed segment it lacks and re-sends only those, byte for byte, and skips
+// segments whose ACK2 came back. Receivers keep
+// segments under DOWNLOAD_DIR/.part-<hash> until the file is complete and its
+// hash checks out. Resume works within the envelope age limit (24h).
+
+const (
+	FILE_SEGMENT_SIZE = 1024
+	FILE_MAX_SIZE     = 256 << 10
+	FILE_MAX_NAME     = 64
+	FILE_WINDOW       = 4               // segments in flight before waiting for ACK2s
+	FILE_ACK_TIMEOUT  = 2 * time.Minute // give up (resumable) when no ACK2 arrives for this long
+)
+
+type fileTransfer struct {
+	Name    string        `json:"name"`
+	RID     string        `json:"rid"`
+	Segs    []fileSegment `json:"segs"`
+	Created time.Time     `json:"created"`
+	Done    bool          `json:"done,omitempty"`
+}
+
+type fileSegment struct {
+	MID       string `json:"mid"`
+	Data      []byte `json:"data"` // sealed ciphertext, re-sent verbatim on resume; nil until first sent
+	AckSecret []byte `json:"ack_secret"`
+	Acked     bool   `json:"acked,omitempty"`
+}
+
+var (
+	filesMu       sync.Mutex
+	transfers     = make(map[string]*fileTransfer) // "<rid>:<hash hex>" -> transfer
+	transfersPath string
+)
+
+// segmentMID is deterministic so a resumed upload lands on the server's existing chunk state.
+func segmentMID(hash []byte, rid string, seg int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("peyk-file|%x|%s|%d", hash, rid, seg)))
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(sum[:]))[:MID_LEN]
+}
+
+func encodeFileSegment(hash []byte, seg, count, size int, name string, data []byte) []byte {
+	out := make([]byte, 0, 32+9+len(name)+len(data))
+	out = append(out, hash...)
+	out = binary.BigEndian.AppendUint16(out, uint16(seg))
+	out = binary.BigEndian.AppendUint16(out, uint16(count))
+	out = binary.BigEndian.AppendUint32(out, uint32(size))
+	out = append(out, byte(len(name)))
+	out = append(out, name...)
+	return append(out, data...)
+}
+
+type fileSegmentBody struct {
+	Hash  []byte
+	Seg   int
+	Count int
+	Size  int
+	Name  string
+	Data  []byte
+}
+
+func decodeFileSegment(b []byte) (fileSegmentBody, error) {
+	if len(b) < 32+9 {
+		return fileSegmentBody{}, fmt.Errorf("file segment too short")
+	}
+	f := fileSegmentBody{
+		Hash:  b[:32],
+		Seg:   int(binary.BigEndian.Uint16(b[32:34])),
+		Count: int(binary.BigEndian.Uint16(b[34:36])),
+		Size:  int(binary.BigEndian.Uint32(b[36:40])),
+	}
+	n := int(b[40])
+	if len(b) < 41+n {
+		return fileSegmentBody{}, fmt.Errorf("file name truncated")
+	}
+	f.Name = string(b[41 : 41+n])
+	f.Data = b[41+n:]
+	if f.Count == 0 || f.Seg >= f.Count || f.Size > FILE_MAX_SIZE || f.Count != (f.Size+FILE_SEGMENT_SIZE-1)/FILE_SEGMENT_SIZE {
+		return fileSegmentBody{}, fmt.Errorf("bad file segment %d/%d size=%d", f.Seg, f.Count, f.Size)
+	}
+	return f, nil
+}
+
+// loadTransfers reads outgoing transfer state; a missing file starts empty.
+func loadTransfers(path string) error {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	transfersPath = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &transfers); err != nil {
+		return err
+	}
+	if transfers == nil {
+		transfers = make(map[string]*fileTransfer)
+	}
+	return nil
+}
+
+// saveTransfersLocked writes transfer state atomically, dropping transfers older
+// than the envelope age limit. filesMu must be held by the caller.
+func saveTransfersLocked() error {
+	for k, t := range transfers {
+		if time.Since(t.Created) > ENVELOPE_MAX_AGE {
+			delete(transfers, k)
+		}
+	}
+	if transfersPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(transfers)
+	if err != nil {
+		return err
+	}
+	tmp := transfersPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, transfersPath)
+}
+
+// sendFile starts or resumes the upload of path to rid.
+func sendFile(path, rid string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("❌ /send-file: %v\n", err)
+		return
+	}
+	if len(content) == 0 || len(content) > FILE_MAX_SIZE {
+		fmt.Printf("❌ /send-file: %s is %d bytes (1..%d allowed)\n", path, len(content), FILE_MAX_SIZE)
+		return
+	}
+	name := filepath.Base(path)
+	if len(name) > FILE_MAX_NAME {
+		name = name[len(name)-FILE_MAX_NAME:]
+	}
+	hash := sha256.Sum256(content)
+	key := fmt.Sprintf("%s:%x", rid, hash)
+
+	count := (len(content) + FILE_SEGMENT_SIZE - 1) / FILE_SEGMENT_SIZE
+	filesMu.Lock()
+	t, resumed := transfers[key]
+	if !resumed {
+		// Segments are sealed when they enter the window, not here: sealing uses up
+		// ratchet message numbers, and the receiver only skips RATCHET_MAX_SKIP of them.
+		t = &fileTransfer{Name: name, RID: rid, Created: time.Now()}
+		for i := 0; i < count; i++ {
+			t.Segs = append(t.Segs, fileSegment{MID: segmentMID(hash[:], rid, i)})
+		}
+		transfers[key] = t
+		if err := saveTransfersLocked(); err != nil {
+			fmt.Printf("⚠️ transfer state save failed (resume won't survive a restart): %v\n", err)
+		}
+	}
+	done, total := 0, len(t.Segs)
+	for _, seg := range t.Segs {
+		if seg.Acked {
+			done++
+		}
+	}
+	finished := t.Done
+	filesMu.Unlock()
+
+	if finished {
+		fmt.Printf("📎 %s was already delivered to %s\n", name, rid)
+		return
+	}
+	if resumed {
+		fmt.Printf("📎 Resuming %s → %s: %d/%d segments delivered\n", name, rid, done, total)
+	} else {
+		fmt.Printf("📎 Sending %s → %s: %d bytes in %d segments (sha256 %x…)\n", name, rid, len(content), total, hash[:8])
+	}
+
+	for i := 0; i < total; i++ {
+		filesMu.Lock()
+		seg := t.Segs[i]
+		filesMu.Unlock()
+		if seg.Acked {
+			continue
+		}
+		if !waitFileWindow(t, i) {
+			fmt.Printf("⏸️ %s: no ACK2 for %s, paused at segment %d/%d (run /send-file again to resume)\n", name, FILE_ACK_TIMEOUT, i+1, total)
+			return
+		}
+		// A segment sealed by an earlier run may be partly on the server already.
+		resend := seg.Data != nil
+		if !resend {
+			data := content[i*FILE_SEGMENT_SIZE : min((i+1)*FILE_SEGMENT_SIZE, len(content))]
+			seg.Data, seg.AckSecret = sealEnvelope(rid, seg.MID, MSG_TYPE_FILE, "", encodeFileSegment(hash[:], i, count, len(content), name, data))
+			filesMu.Lock()
+			t.Segs[i].Data, t.Segs[i].AckSecret = seg.Data, seg.AckSecret
+			if err := saveTransfersLocked(); err != nil {
+				fmt.Printf("⚠️ transfer state save failed (resume won't survive a restart): %v\n", err)
+			}
+			filesMu.Unlock()
+		}
+		fmt.Printf("📎 %s: segment %d/%d\n", name, i+1, total)
+		if sendEncrypted(rid, seg.MID, seg.Data, seg.AckSecret, PRIORITY_BULK, resend) == STATUS_DELIVERED {
+			// Only a hint: the status is unauthenticated. The server re-queues the
+			// receiver's ACK2, and handleFileAck2 checks its MAC before we count it.
+			fmt.Printf("📎 %s: server says segment %d/%d was delivered, waiting for its ACK2\n", name, i+1, total)
+		}
+	}
+}
+
+// waitFileWindow blocks until fewer than FILE_WINDOW segments before next are unacknowledged.
+func waitFileWindow(t *fileTransfer, next int) bool {
+	deadline := time.Now().Add(FILE_ACK_TIMEOUT)
+	for time.Now().Before(deadline) {
+		filesMu.Lock()
+		pending := 0
+		for _, seg := range t.Segs[:next] {
+			if !seg.Acked {
+				pending++
+			}
+		}
+		filesMu.Unlock()
+		if pending < FILE_WINDOW {
+			return true
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return false
+}
+
+// handleFileAck2 marks an outgoing segment delivered once its ACK2 MAC checks out.
+func handleFileAck2(tot int, mid, mac string) {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	for _, t := range transfers {
+		for i := range t.Segs {
+			seg := &t.Segs[i]
+			if seg.MID != mid || seg.Acked {
+				continue
+			}
+			if !hmac.Equal([]byte(ack2MAC(seg.AckSecret, MY_ID, tot, mid)), []byte(mac)) {
+				return
+			}
+			seg.Acked = true
+			done := 0
+			for _, s := range t.Segs {
+				if s.Acked {
+					done++
+				}
+			}
+			if done == len(t.Segs) {
+				t.Done = true
+				for j := range t.Segs {
+					t.Segs[j].Data = nil // keep the record so a re-send says "already delivered"
+				}
+				fmt.Printf("📎 %s delivered to %s (%d segments)\n", t.Name, t.RID, done)
+			}
+			if err := saveTransfersLocked(); err != nil {
+				fmt.Printf("⚠️ transfer state save failed: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+// handleFileSegment stores one received segment and assembles the file when all are in.
+func handleFileSegment(senderID, mid string, body []byte) {
+	f, err := decodeFileSegment(body)
+	if err != nil {
+		fmt.Printf("❌ File segment from %s mid=%s: %v\n", senderID, mid, err)
+		return
+	}
+	partDir := filepath.Join(DOWNLOAD_DIR, fmt.Sprintf(".part-%x", f.Hash[:8]))
+	if err := os.MkdirAll(partDir, 0700); err != nil {
+		fmt.Printf("❌ File segment: %v\n", err)
+		return
+	}
+	segPath := filepath.Join(partDir, strconv.Itoa(f.Seg))
+	if err := os.WriteFile(segPath+".tmp", f.Data, 0600); err != nil {
+		fmt.Printf("❌ File segment: %v\n", err)
+		return
+	}
+	if err := os.Rename(segPath+".tmp", segPath); err != nil {
+		fmt.Printf("❌ File segment: %v\n", err)
+		return
+	}
+
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	entries, err := os.ReadDir(partDir)
+	if err != nil {
+		return
+	}
+	have := 0
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil && n < f.Count {
+			have++
+		}
+	}
+	fmt.Printf("📎 [%s] %s: segment %d/%d (%d received)\n", senderID, safeFileName(f.Name), f.Seg+1, f.Count, have)
+	if have < f.Count {
+		return
+	}
+
+	var content []byte
+	for i := 0; i < f.Count; i++ {
+		b, err := os.ReadFile(filepath.Join(partDir, strconv.Itoa(i)))
+		if err != nil {
+			fmt.Printf("❌ File assemble: %v\n", err)
+			return
+		}
+		content = append(content, b...)
+	}
+	if sum := sha256.Sum256(content); len(content) != f.Size || !bytes.Equal(sum[:], f.Hash) {
+		fmt.Printf("❌ File %s from %s failed its hash check, discarded\n", safeFileName(f.Name), senderID)
+		os.RemoveAll(partDir)
+		return
+	}
+	out := filepath.Join(DOWNLOAD_DIR, safeFileName(f.Name))
+	if _, err := os.Stat(out); err == nil {
+		out = filepath.Join(DOWNLOAD_DIR, fmt.Sprintf("%x-%s", f.Hash[:4], safeFileName(f.Name)))
+	}
+	if err := os.WriteFile(out, content, 0600); err != nil {
+		fmt.Printf("❌ File write: %v\n", err)
+		return
+	}
+	os.RemoveAll(partDir)
+	fmt.Printf("\n📎 FILE RECEIVED [%s] %s (%d bytes) → %s\n\n", senderID, safeFileName(f.Name), f.Size, out)
+}
+
+// safeFileName keeps a received name inside DOWNLOAD_DIR.
+func safeFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" || name == "" || strings.HasPrefix(name, ".") {
+		return "file.bin"
+	}
+	return name
+}
+
+// ───────────────────────── FEC (Reed-Solomon) ─────────────────────────
+//
+// Systematic Reed-Solomon erasure code over GF(256) with a Cauchy parity matrix:
+// chunks 1..k carry the data, chunks k+1..k+m carry parity, and any k of the
+// k+m chunks rebuild the message. The data is length-prefixed (2 bytes) and
+// zero-padded to k equal shards; each shard is Base32-encoded into one chunk.
+// Labels carry "f<m>" so the receiver knows k = tot - m.
+
+var gfExp, gfLog = buildGFTables()
+
+func buildGFTables() ([512]byte, [256]byte) {
+	var exp [512]byte
+	var lg [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		lg[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, lg
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// fecRow returns the encoding row for shard r (identity for data, Cauchy for parity).
+func fecRow(r, k int) []byte {
+	row := make([]byte, k)
+	if r < k {
+		row[r] = 1
+		return row
+	}
+	for j := 0; j < k; j++ {
+		row[j] = gfInv(byte(r) ^ byte(j))
+	}
+	return row
+}
+
+// fecParity reads the "f<m>" parity count from chunk ext tokens (0 if absent).
+func fecParity(ext []string) int {
+	for _, t := range ext {
+		if len(t) > 1 && t[0] == 'f' {
+			if n, err := strconv.Atoi(t[1:]); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// fecEncodeChunks splits data into k Base32 data chunks plus ceil(k*FEC_RATIO) parity chunks.
+// It returns parity=0 when the message is too large for the shard limit.
+func fecEncodeChunks(data []byte, room int) ([]string, int) {
+	shardSize := room * 5 / 8
+	if shardSize <= 0 || len(data) > 0xffff {
+		return nil, 0
+	}
+	buf := make([]byte, 2, 2+len(data))
+	buf[0], buf[1] = byte(len(data)>>8), byte(len(data))
+	buf = append(buf, data...)
+
+	k := (len(buf) + shardSize - 1) / shardSize
+	m := int(math.Ceil(float64(k) * FEC_RATIO))
+	if k+m > FEC_MAX_SHARDS {
+		m = FEC_MAX_SHARDS - k
+	}
+	if m <= 0 {
+		return nil, 0
+	}
+
+	shards := make([][]byte, k+m)
+	for i := 0; i < k; i++ {
+		shards[i] = make([]byte, shardSize)
+		end := (i + 1) * shardSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		copy(shards[i], buf[i*shardSize:end])
+	}
+	for r := k; r < k+m; r++ {
+		row := fecRow(r, k)
+		shards[r] = make([]byte, shardSize)
+		for j := 0; j < k; j++ {
+			for b := 0; b < shardSize; b++ {
+				shards[r][b] ^= gfMul(row[j], shards[j][b])
+			}
+		}
+	}
+
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	out := make([]string, len(shards))
+	for i, sh := range shards {
+		out[i] = strings.ToLower(enc.EncodeToString(sh))
+	}
+	return out, m
+}
+
+// fecDecodeChunks rebuilds the original bytes from any k of the tot chunks (keys are 1-based).
+func fecDecodeChunks(chunks map[int]string, tot, parity int) ([]byte, error) {
+	k := tot - parity
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	var (
+		rows      []int
+		shards    [][]byte
+		shardSize = -1
+	)
+	for i := 1; i <= tot && len(rows) < k; i++ {
+		c, ok := chunks[i]
+		if !ok {
+			continue
+		}
+		sh, err := enc.DecodeString(strings.ToUpper(c))
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %v", i, err)
+		}
+		if shardSize >= 0 && len(sh) != shardSize {
+			return nil, fmt.Errorf("chunk %d: shard size %d, want %d", i, len(sh), shardSize)
+		}
+		shardSize = len(sh)
+		rows = append(rows, i-1)
+		shards = append(shards, sh)
+	}
+	if len(rows) < k {
+		return nil, fmt.Errorf("need %d chunks, have %d", k, len(rows))
+	}
+
+	// Invert the k×k matrix of the received rows (Gauss-Jordan in GF(256)).
+	mat := make([][]byte, k)
+	inv := make([][]byte, k)
+	for i, r := range rows {
+		mat[i] = fecRow(r, k)
+		inv[i] = make([]byte, k)
+		inv[i][i] = 1
+	}
+	for col := 0; col < k; col++ {
+		pivot := -1
+		for r := col; r < k; r++ {
+			if mat[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, fmt.Errorf("singular FEC matrix")
+		}
+		mat[col], mat[pivot] = mat[pivot], mat[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		scale := gfInv(mat[col][col])
+		for j := 0; j < k; j++ {
+			mat[col][j] = gfMul(mat[col][j], scale)
+			inv[col][j] = gfMul(inv[col][j], scale)
+		}
+		for r := 0; r < k; r++ {
+			if r == col || mat[r][col] == 0 {
+				continue
+			}
+			f := mat[r][col]
+			for j := 0; j < k; j++ {
+				mat[r][j] ^= gfMul(f, mat[col][j])
+				inv[r][j] ^= gfMul(f, inv[col][j])
+			}
+		}
+	}
+
+	buf := make([]byte, 0, k*shardSize)
+	for d := 0; d < k; d++ {
+		out := make([]byte, shardSize)
+		for i := 0; i < k; i++ {
+			if inv[d][i] == 0 {
+				continue
+			}
+			for b := 0; b < shardSize; b++ {
+				out[b] ^= gfMul(inv[d][i], shards[i][b])
+			}
+		}
+		buf = append(buf, out...)
+	}
+
+	if len(buf) < 2 {
+		return nil, fmt.Errorf("FEC payload too short")
+	}
+	n := int(buf[0])<<8 | int(buf[1])
+	if 2+n > len(buf) {
+		return nil, fmt.Errorf("FEC length %d exceeds %d", n, len(buf)-2)
+	}
+	return buf[2 : 2+n], nil
+}
+
+// ───────────────────────── Message Envelope ─────────────────────────
+//
+// Legacy plaintext is raw UTF-8. Framed plaintext starts with a 0x00 byte
+// (never the first byte of a chat message) followed by a version and a flags
+// byte. Flag bit 0 = body is raw DEFLATE with compressDict as preset dictionary.
+//
+//	v1: 0x00 | 1 | flags | body
+//	v2: 0x00 | 2 | flags | type | sentAt (u64 unix ms) | len+sid | len+mid | len+replyTo | body | tag[16]
+//
+// The v2 tag is HMAC-SHA256 over everything before it, keyed per sender ID,
+// and the receiver checks sid/mid against the chunk labels and the timestamp
+// against ENVELOPE_MAX_AGE, so relabelled or stale messages are rejected.
+
+const (
+	PLAIN_MAGIC        = 0x00
+	PLAIN_FLAG_DEFLATE = 0x01
+
+	ENVELOPE_VERSION = 2
+	ENVELOPE_TAG_LEN = 16
+
+	MSG_TYPE_TEXT = 1
+	MSG_TYPE_KEX  = 2 // body = sender's 32-byte X25519 public key
+	MSG_TYPE_FILE = 3 // body = one file segment (see File Transfer)
+)
+
+type msgEnvelope struct {
+	Version  byte // 0 = legacy raw text
+	Type     byte
+	SenderID string
+	MsgID    string
+	ReplyTo  string
+	SentAt   time.Time
+	Body     []byte
+	Tag      []byte // v2 only; also keys the ACK2 MAC
+}
+
+// envelopeKey derives the per-sender tag key from the master key.
+func envelopeKey(senderID string) []byte {
+	return deriveSubkey("peyk-envelope:" + senderID)
+}
+
+func envelopeTag(senderID string, data []byte) []byte {
+	mac := hmac.New(sha256.New, envelopeKey(senderID))
+	mac.Write(data)
+	return mac.Sum(nil)[:ENVELOPE_TAG_LEN]
+}
+
+// encodeEnvelope serializes e as v2. With compress it deflates the body when that makes it smaller.
+func encodeEnvelope(e msgEnvelope, compress bool) []byte {
+	body := e.Body
+	flags := byte(0)
+	if compress {
+		if z, err := deflateBody(body); err == nil && len(z) < len(body) {
+			body = z
+			flags |= PLAIN_FLAG_DEFLATE
+		}
+	}
+
+	out := make([]byte, 0, 64+len(body))
+	out = append(out, PLAIN_MAGIC, ENVELOPE_VERSION, flags, e.Type)
+	out = binary.BigEndian.AppendUint64(out, uint64(e.SentAt.UnixMilli()))
+	for _, f := range []string{e.SenderID, e.MsgID, e.ReplyTo} {
+		out = append(out, byte(len(f)))
+		out = append(out, f...)
+	}
+	out = append(out, body...)
+	return append(out, envelopeTag(e.SenderID, out)...)
+}
+
+// decodeEnvelope parses legacy, v1 and v2 plaintext. The v2 tag is verified here.
+func decodeEnvelope(plain []byte) (msgEnvelope, error) {
+	if len(plain) == 0 || plain[0] != PLAIN_MAGIC {
+		return msgEnvelope{Type: MSG_TYPE_TEXT, Body: plain}, nil
+	}
+	if len(plain) < 3 {
+		return msgEnvelope{}, fmt.Errorf("plaintext header too short")
+	}
+	e := msgEnvelope{Version: plain[1], Type: MSG_TYPE_TEXT}
+	flags := plain[2]
+	var body []byte
+
+	switch e.Version {
+	case 1:
+		body = plain[3:]
+	case ENVELOPE_VERSION:
+		if len(plain) < 4+8+3+ENVELOPE_TAG_LEN {
+			return msgEnvelope{}, fmt.Errorf("envelope too short")
+		}
+		signed, tag := plain[:len(plain)-ENVELOPE_TAG_LEN], plain[len(plain)-ENVELOPE_TAG_LEN:]
+		e.Type = signed[3]
+		e.SentAt = time.UnixMilli(int64(binary.BigEndian.Uint64(signed[4:12])))
+		off := 12
+		fields := make([]string, 3)
+		for i := range fields {
+			if off >= len(signed) || off+1+int(signed[off]) > len(signed) {
+				return msgEnvelope{}, fmt.Errorf("envelope field %d truncated", i)
+			}
+			n := int(signed[off])
+			fields[i] = string(signed[off+1 : off+1+n])
+			off += 1 + n
+		}
+		e.SenderID, e.MsgID, e.ReplyTo = fields[0], fields[1], fields[2]
+		if !hmac.Equal(tag, envelopeTag(e.SenderID, signed)) {
+			return msgEnvelope{}, fmt.Errorf("envelope tag mismatch")
+		}
+		e.Tag = append([]byte(nil), tag...)
+		body = signed[off:]
+	default:
+		return msgEnvelope{}, fmt.Errorf("unsupported envelope version %d", e.Version)
+	}
+
+	if flags&PLAIN_FLAG_DEFLATE != 0 {
+		b, err := inflateBody(body)
+		if err != nil {
+			return msgEnvelope{}, fmt.Errorf("inflate: %v", err)
+		}
+		body = b
+	}
+	e.Body = body
+	return e, nil
+}
+
+// validateEnvelope checks the envelope against the chunk labels it arrived with.
+func validateEnvelope(e msgEnvelope, senderID, mid string) error {
+	if e.Version < ENVELOPE_VERSION {
+		if REQUIRE_ENVELOPE {
+			return fmt.Errorf("no authenticated envelope")
+		}
+		return nil
+	}
+	if e.SenderID != senderID {
+		return fmt.Errorf("sender mismatch: label=%s envelope=%s", senderID, e.SenderID)
+	}
+	if e.MsgID != mid {
+		return fmt.Errorf("message id mismatch: label=%s envelope=%s", mid, e.MsgID)
+	}
+	age := time.Since(e.SentAt)
+	if age > ENVELOPE_MAX_AGE {
+		return fmt.Errorf("stale message (sent %s ago)", age.Round(time.Second))
+	}
+	if age < -ENVELOPE_MAX_SKEW {
+		return fmt.Errorf("message from the future (%s ahead)", (-age).Round(time.Second))
+	}
+	return nil
+}
+
+// compressDict primes DEFLATE with phrases common in short chat messages.
+// Both ends must use the identical dictionary; most frequent material goes last.
+var compressDict = []byte("" +
+	"please call me when you can. are you safe? where are you now? " +
+	"the internet is down here. no electricity since last night. " +
+	"we are at home, everyone is fine. send news. message received. " +
+	"tomorrow morning today tonight family hospital water food help " +
+	"کجا هستید؟ حالتون خوبه؟ اینترنت قطع است. برق نداریم. " +
+	"ما در خانه هستیم، همه خوب هستند. خبر بده. پیام رسید. " +
+	"فردا صبح امروز امشب خانواده بیمارستان آب غذا کمک " +
+	"سلام، خوبی؟ من خوبم. ممنون. باشه. لطفا زنگ بزن. " +
+	"hello, how are you? i am ok. thanks. ok. yes no " +
+	"سلام خوبی من خوبم ممنون باشه بله نه است هست را که با از به در و ")
+
+func deflateBody(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, compressDict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func inflateBody(b []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(b), compressDict)
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, MAX_PLAINTEXT_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MAX_PLAINTEXT_SIZE {
+		return nil, fmt.Errorf("inflated body exceeds %d bytes", MAX_PLAINTEXT_SIZE)
+	}
+	return out, nil
+}
+
+// ───────────────────────── Crypto ─────────────────────────
+//
+// Ciphertext formats (the first byte tells them apart):
+//
+//	legacy (v1): nonce[12] | ct+tag             key = SHA-256(passphrase)
+//	v2:          0x02 | nonce[12] | ct+tag      key = HKDF(masterKey, "peyk-conv:<a>:<b>")
+//	v3:          0x03 | nonce[12] | ct+tag      key = HKDF(X25519(me, peer), "peyk-pair:<a>:<b>")
+//	v4:          0x04 | header[40] | nonce[12] | ct+tag   key = double-ratchet message key
+//
+// masterKey = PBKDF2-SHA256(passphrase, PEYK_KDF_SALT, PEYK_KDF_ITERATIONS) and
+// <a>:<b> are the two node IDs sorted, so each pair of nodes gets its own key.
+// The version byte is bound as AES-GCM additional data. Decrypt tries v2 first
+// and falls back to the legacy key, so both can coexist during migration.
+// v3 needs the peer's public key from a prior key exchange (see Keystore);
+// v4 additionally needs a ratchet session (see Double Ratchet). Once a peer's
+// key is pinned, its direct messages must use v3 or v4 (see keyDowngraded).
+
+const (
+	KEY_VERSION_LEGACY  = 1
+	KEY_VERSION_KDF     = 2
+	KEY_VERSION_PAIR    = 3
+	KEY_VERSION_RATCHET = 4
+
+	// Accept legacy SHA-256(passphrase) ciphertexts while clients migrate
+	ACCEPT_LEGACY_KEY = true
+)
+
+func deriveMasterKey(passphrase, salt string, iterations int) []byte {
+	key, err := pbkdf2.Key(sha256.New, passphrase, []byte(salt), iterations, 32)
+	if err != nil {
+		log.Fatalf("key derivation failed: %v", err)
+	}
+	return key
+}
+
+// deriveSubkey expands a purpose-bound 32-byte key from the master key.
+func deriveSubkey(info string) []byte {
+	key, err := hkdf.Expand(sha256.New, masterKey, info, 32)
+	if err != nil {
+		log.Fatalf("subkey derivation failed: %v", err)
+	}
+	return key
+}
+
+// conversationKey is shared by both directions between nodes a and b.
+func conversationKey(a, b string) []byte {
+	if a > b {
+		a, b = b, a
+	}
+	return deriveSubkey("peyk-conv:" + a + ":" + b)
+}
+
+func legacyKey() []byte {
+	hash := sha256.Sum256([]byte(PASSPHRASE))
+	return hash[:]
+}
+
+// encrypt seals plain for the conversation between sid and rid in the given key version.
+func encrypt(plain []byte, sid, rid string, version int) []byte {
+	switch version {
+	case KEY_VERSION_LEGACY:
+		return sealGCM(legacyKey(), plain, nil)
+	case KEY_VERSION_RATCHET:
+		data, err := ratchetEncrypt(rid, plain)
+		if err == nil {
+			return data
+		}
+		fmt.Printf("⚠️ Ratchet unavailable for %s (%v), using pair key\n", rid, err)
+		fallthrough
+	case KEY_VERSION_PAIR:
+		if key := pairKey(rid); key != nil {
+			ad := []byte{KEY_VERSION_PAIR}
+			return append(ad, sealGCM(key, plain, ad)...)
+		}
+	}
+	ad := []byte{KEY_VERSION_KDF}
+	return append(ad, sealGCM(conversationKey(sid, rid), plain, ad)...)
+}
+
+// decrypt also returns the key version that opened data, so the caller can refuse
+// a downgrade (see keyDowngraded).
+func decrypt(data []byte, sid, rid string) (string, int, error) {
+	if len(data) > 0 && data[0] == KEY_VERSION_RATCHET {
+		plain, err := ratchetDecrypt(sid, data)
+		if err == nil {
+			return string(plain), KEY_VERSION_RATCHET, nil
+		}
+		if !ACCEPT_LEGACY_KEY {
+			return "", 0, err
+		}
+		// may still be an older format whose nonce starts with 0x04
+		if p, err2 := openGCM(legacyKey(), data, nil); err2 == nil {
+			return string(p), KEY_VERSION_LEGACY, nil
+		}
+		return "", 0, err
+	}
+	if len(data) > 0 && data[0] == KEY_VERSION_PAIR {
+		if key := pairKey(sid); key != nil {
+			if plain, err := openGCM(key, data[1:], data[:1]); err == nil {
+				return string(plain), KEY_VERSION_PAIR, nil
+			}
+		}
+		// no (or a stale) key for sid, or a v2/legacy nonce starting with 0x03
+	}
+	if len(data) > 0 && data[0] == KEY_VERSION_KDF {
+		plain, err := openGCM(conversationKey(sid, rid), data[1:], data[:1])
+		if err == nil || !ACCEPT_LEGACY_KEY {
+			return string(plain), KEY_VERSION_KDF, err
+		}
+		// a legacy nonce can start with 0x02 too; fall through
+	}
+	if !ACCEPT_LEGACY_KEY {
+		return "", 0, fmt.Errorf("unknown key version")
+	}
+	plain, err := openGCM(legacyKey(), data, nil)
+	return string(plain), KEY_VERSION_LEGACY, err
+}
+
+// keyDowngraded reports whether a direct message from sid was sealed with a
+// passphrase key although sid's public key is pinned (and any ratchet session
+// hangs off that pin). Everyone holding the passphrase can forge those, so once
+// a pin exists only key exchanges may still use them.
+func keyDowngraded(sid, rid string, version int, msgType byte) bool {
+	if version >= KEY_VERSION_PAIR || msgType == MSG_TYPE_KEX || rid != strings.ToLower(MY_ID) {
+		return false
+	}
+	return peerPublicKey(sid) != nil
+}
+
+// sealGCM returns nonce | ciphertext+tag.
+func sealGCM(key, plain, ad []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	aesgcm, _ := cipher.NewGCM(block)
+
+	nonce := make([]byte, 12)
+	_, _ = io.ReadFull(rand.Reader, nonce)
+
+	encrypted := aesgcm.Seal(nil, nonce, plain, ad)
+	return append(nonce, encrypted...)
+}
+
+func openGCM(key, data, ad []byte) ([]byte, error) {
+	block, _ := aes.NewCipher(key)
+	aesgcm, _ := cipher.NewGCM(block)
+
+	if len(data) < 12+16 {
+		return nil, fmt.Errorf("data too short")
+	}
+
+	nonce := data[:12]
+	ciphertext := data[12:]
+
+	return aesgcm.Open(nil, nonce, ciphertext, ad)
+}
+
+// ───────────────────────── Keystore (X25519) ─────────────────────────
+//
+// Each node has a long-term X25519 identity key. Public keys travel as
+// MSG_TYPE_KEX envelopes over the normal chunk/poll path (under the
+// conversation key) and are pinned on first use. Fingerprints are the first
+// 16 bytes of SHA-256(public key) and should be compared out of band.
+
+type keystoreContact struct {
+	PublicKey string    `json:"public_key"`
+	AddedAt   time.Time `json:"added_at"`
+}
+
+type keystoreFile struct {
+	PrivateKey string                     `json:"private_key"`
+	Contacts   map[string]keystoreContact `json:"contacts"`
+	Sessions   map[string]*ratchetSession `json:"sessions,omitempty"`
+	ServerKey  string                     `json:"server_key,omitempty"`
+	NodeID     string                     `json:"node_id,omitempty"`
+}
+
+var (
+	ksMu       sync.Mutex
+	ksPath     string
+	ksPriv     *ecdh.PrivateKey
+	ksContacts = make(map[string]*ecdh.PublicKey)
+	ksAddedAt  = make(map[string]time.Time)
+	ksSessions = make(map[string]*ratchetSession)
+	ksServer   string // pinned server key (Base32), see registerNode
+	ksNodeID   string // generated node ID, used unless PEYK_NODE_ID is set
+	nodeSecret []byte
+)
+
+// loadKeystore reads the keystore, creating it with a fresh identity key and node
+// ID if missing.
+func loadKeystore(path string) error {
+	ksMu.Lock()
+	defer ksMu.Unlock()
+	ksPath = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		ksPriv = priv
+		ksNodeID = generateID(NODE_ID_LEN)
+		fmt.Printf("🔑 Generated new identity key and node ID %s in %s\n", ksNodeID, path)
+		return saveKeystoreLocked()
+	}
+	if err != nil {
+		return err
+	}
+
+	var f keystoreFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	raw, err := hex.DecodeString(f.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("private key: %v", err)
+	}
+	if ksPriv, err = ecdh.X25519().NewPrivateKey(raw); err != nil {
+		return fmt.Errorf("private key: %v", err)
+	}
+	for id, c := range f.Contacts {
+		raw, err := hex.DecodeString(c.PublicKey)
+		if err != nil {
+			return fmt.Errorf("contact %s: %v", id, err)
+		}
+		pub, err := ecdh.X25519().NewPublicKey(raw)
+		if err != nil {
+			return fmt.Errorf("contact %s: %v", id, err)
+		}
+		ksContacts[id] = pub
+		ksAddedAt[id] = c.AddedAt
+	}
+	for id, sess := range f.Sessions {
+		if _, ok := ksContacts[id]; ok && sess != nil {
+			ksSessions[id] = sess
+		}
+	}
+	ksServer = f.ServerKey
+	if ksNodeID = f.NodeID; ksNodeID == "" { // keystore from before generated node IDs
+		ksNodeID = generateID(NODE_ID_LEN)
+		fmt.Printf("🆔 Generated node ID %s in %s\n", ksNodeID, path)
+		return saveKeystoreLocked()
+	}
+	return nil
+}
+
+// saveKeystoreLocked writes the keystore atomically. ksMu must be held by the caller.
+func saveKeystoreLocked() error {
+	f := keystoreFile{
+		PrivateKey: hex.EncodeToString(ksPriv.Bytes()),
+		Contacts:   make(map[string]keystoreContact, len(ksContacts)),
+	}
+	for id, pub := range ksContacts {
+		f.Contacts[id] = keystoreContact{PublicKey: hex.EncodeToString(pub.Bytes()), AddedAt: ksAddedAt[id]}
+	}
+	if len(ksSessions) > 0 {
+		f.Sessions = ksSessions
+	}
+	f.ServerKey = ksServer
+	f.NodeID = ksNodeID
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ksPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ksPath)
+}
+
+func myPublicKey() []byte {
+	ksMu.Lock()
+	defer ksMu.Unlock()
+	return ksPriv.PublicKey().Bytes()
+}
+
+func peerPublicKey(id string) *ecdh.PublicKey {
+	ksMu.Lock()
+	defer ksMu.Unlock()
+	return ksContacts[strings.ToLower(id)]
+}
+
+// pairKey derives the AES key shared with peer, or nil if we have no key for it.
+func pairKey(peer string) []byte {
+	peer = strings.ToLower(peer)
+	ksMu.Lock()
+	pub, ok := ksContacts[peer]
+	priv := ksPriv
+	ksMu.Unlock()
+	if !ok || priv == nil {
+		return nil
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil
+	}
+	a, b := strings.ToLower(MY_ID), peer
+	if a > b {
+		a, b = b, a
+	}
+	key, err := hkdf.Key(sha256.New, shared, nil, "peyk-pair:"+a+":"+b, 32)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+func fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	h := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(h)/4)
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+func sendKeyExchange() {
+	fmt.Printf("🔑 Sending my public key to %s (fingerprint %s)\n", TARGET_ID, fingerprint(myPublicKey()))
+	sendEnvelope(MSG_TYPE_KEX, "", myPublicKey())
+}
+
+// handleKeyExchange pins a peer key on first use and answers with our own key.
+// A changed key is never accepted silently: the user must /forget the old one.
+func handleKeyExchange(senderID string, body []byte) {
+	pub, err := ecdh.X25519().NewPublicKey(body)
+	if err != nil {
+		fmt.Printf("❌ Invalid key exchange from %s: %v\n", senderID, err)
+		return
+	}
+
+	ksMu.Lock()
+	old, known := ksContacts[senderID]
+	if known && !old.Equal(pub) {
+		ksMu.Unlock()
+		fmt.Printf("🚨 KEY CHANGED for %s! new fingerprint %s (pinned %s). Verify out of band, then /forget %s and ask for /kex again.\n",
+			senderID, fingerprint(pub.Bytes()), fingerprint(old.Bytes()), senderID)
+		return
+	}
+	if known {
+		ksMu.Unlock()
+		fmt.Printf("🔑 Key for %s already pinned (%s)\n", senderID, fingerprint(pub.Bytes()))
+		return
+	}
+	ksContacts[senderID] = pub
+	ksAddedAt[senderID] = time.Now()
+	err = saveKeystoreLocked()
+	ksMu.Unlock()
+	if err != nil {
+		fmt.Printf("⚠️ Could not save keystore: %v\n", err)
+	}
+
+	fmt.Printf("🔑 Pinned key for %s, fingerprint %s — compare it out of band!\n", senderID, fingerprint(pub.Bytes()))
+	if senderID == strings.ToLower(TARGET_ID) {
+		go sendKeyExchange()
+	}
+}
+
+func forgetPeerKey(id string) {
+	ksMu.Lock()
+	defer ksMu.Unlock()
+	if _, ok := ksContacts[id]; !ok {
+		fmt.Printf("🔑 No key pinned for %s\n", id)
+		return
+	}
+	delete(ksContacts, id)
+	delete(ksAddedAt, id)
+	delete(ksSessions, id)
+	if err := saveKeystoreLocked(); err != nil {
+		fmt.Printf("⚠️ Could not save keystore: %v\n", err)
+		return
+	}
+	fmt.Printf("🔑 Forgot key for %s\n", id)
+}
+
+func printKeys() {
+	ksMu.Lock()
+	defer ksMu.Unlock()
+	fmt.Printf("🔑 %s (me): %s\n", MY_ID, fingerprint(ksPriv.PublicKey().Bytes()))
+	ids := make([]string, 0, len(ksContacts))
+	for id := range ksContacts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Printf("🔑 %s: %s (pinned %s)\n", id, fingerprint(ksContacts[id].Bytes()), ksAddedAt[id].Format("2006-01-02 15:04"))
+	}
+}
+
+// ───────────────────────── Node Registration ─────────────────────────
+//
+// "v1.reg.<MY_ID>.<identity pub>" binds our node ID to our identity key on
+// the server. The answer "REG-OK-<server pub>" lets us derive the same node
+// secret the server holds: HKDF(X25519(identity key, server key), "peyk-node:<id>").
+// Polls then carry "<nonce>.<token>", a rolling HMAC over the current time
+// window and a fresh nonce, so nobody else can drain our queue or replay our polls.
+// The server key is pinned in the keystore (or by PEYK_SERVER_PUBKEY).
+
+func registerNode() {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	domain := queryName(fmt.Sprintf("v1.reg.%s.%s", strings.ToLower(MY_ID), strings.ToLower(enc.EncodeToString(myPublicKey()))))
+
+	var reply string
+	for i := 0; i < 3 && reply == ""; i++ {
+		if DIRECT_SERVER_IP != "" {
+			reply = pollDirect(domain)
+		} else {
+			reply = pollRecursive(domain)
+		}
+	}
+	serverPub, ok := strings.CutPrefix(reply, "REG-OK-")
+	if !ok {
+		if reply == "" {
+			reply = "no answer"
+		}
+		fmt.Printf("⚠️ Registration failed (%s): polling unauthenticated\n", reply)
+		return
+	}
+	serverPub = strings.ToLower(serverPub)
+
+	ksMu.Lock()
+	defer ksMu.Unlock()
+	pinned := SERVER_PUBKEY
+	if pinned == "" {
+		pinned = ksServer
+	}
+	if pinned != "" && pinned != serverPub {
+		fmt.Printf("🚫 Server key changed (pinned %s…, got %s…): refusing to use it\n", pinned[:12], serverPub[:12])
+		return
+	}
+	raw, err := enc.DecodeString(strings.ToUpper(serverPub))
+	if err != nil {
+		fmt.Printf("⚠️ Registration failed: bad server key: %v\n", err)
+		return
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		fmt.Printf("⚠️ Registration failed: bad server key: %v\n", err)
+		return
+	}
+	shared, err := ksPriv.ECDH(pub)
+	if err != nil {
+		fmt.Printf("⚠️ Registration failed: %v\n", err)
+		return
+	}
+	secret, err := hkdf.Key(sha256.New, shared, nil, "peyk-node:"+strings.ToLower(MY_ID), 32)
+	if err != nil {
+		fmt.Printf("⚠️ Registration failed: %v\n", err)
+		return
+	}
+	nodeSecret = secret
+	if ksServer == "" {
+		ksServer = serverPub
+		if err := saveKeystoreLocked(); err != nil {
+			fmt.Printf("⚠️ keystore save failed: %v\n", err)
+		}
+	}
+	fmt.Printf("🪪 Registered %s with server %s\n", MY_ID, fingerprint(raw))
+}
+
+func currentNodeSecret() []byte {
+	ksMu.Lock()
+	defer ksMu.Unlock()
+	return nodeSecret
+}
+
+// pollToken authenticates "v1.sync.<rid>.<nonce>" for the window containing t (same as server).
+func pollToken(secret []byte, rid string, t time.Time, nonce string) string {
+	window := t.Unix() / int64(POLL_WINDOW/time.Second)
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "poll|%s|%d|%s", strings.ToLower(rid), window, nonce)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(m.Sum(nil)))[:POLL_MAC_LEN]
+}
+
+// ───────────────────────── Cover Traffic ─────────────────────────
+//
+// Dummy polls and chunks are marked with an HMAC under the node secret so the
+// server (and nobody else) can recognize and discard them:
+//
+//	dummy chunk: mid   = coverTag(secret, <replay token>)[:MID_LEN]
+//	dummy poll:  nonce = <4 random chars> + coverTag(secret, <those 4 chars>)[:4]
+//
+// Gaps are drawn from an exponential distribution, so neither the dummies nor
+// the real polls (see startPolling) have a fixed rhythm.
+
+var (
+	statRealPolls   uint64
+	statRealChunks  uint64
+	statCoverPolls  uint64
+	statCoverChunks uint64
+)
+
+func coverTraffic() {
+	go func() {
+		for {
+			time.Sleep(coverDelay(COVER_DUMMY_POLL))
+			sendCoverPoll()
+		}
+	}()
+	for {
+		time.Sleep(coverDelay(COVER_DUMMY_CHUNK))
+		sendCoverChunk()
+	}
+}
+
+// coverDelay draws an exponential gap with the given mean, clamped to [mean/10, 4*mean].
+func coverDelay(mean time.Duration) time.Duration {
+	d := time.Duration(mrand.ExpFloat64() * float64(mean))
+	if d < mean/10 {
+		d = mean / 10
+	}
+	if d > 4*mean {
+		d = 4 * mean
+	}
+	return d
+}
+
+func coverTag(secret []byte, input string) string {
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "cover|%s", input)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return strings.ToLower(enc.EncodeToString(m.Sum(nil)))
+}
+
+func sendCoverPoll() {
+	secret := currentNodeSecret()
+	if secret == nil {
+		return
+	}
+	head := generateID(4)
+	pollOnce(head + coverTag(secret, head)[:4])
+	atomic.AddUint64(&statCoverPolls, 1)
+}
+
+func sendCoverChunk() {
+	secret := currentNodeSecret()
+	if secret == nil {
+		return
+	}
+	token := replayToken()
+	mid := coverTag(secret, token[1:])[:MID_LEN]
+	ext := []string{fmt.Sprintf("v%d", PROTOCOL_VERSION)}
+	total := 1 + mrand.Intn(6)
+	label := chunkLabel(TARGET_ID, 1+mrand.Intn(total), total, mid, generateID(chunkRoom(TARGET_ID, mid, ext)), ext, token)
+	uploadQuery(queryName(label + "." + token))
+	atomic.AddUint64(&statCoverChunks, 1)
+}
+
+func printCoverStats() {
+	var (
+		polls   = atomic.LoadUint64(&statRealPolls)
+		chunks  = atomic.LoadUint64(&statRealChunks)
+		cPolls  = atomic.LoadUint64(&statCoverPolls)
+		cChunks = atomic.LoadUint64(&statCoverChunks)
+	)
+	fmt.Printf("🎭 Cover traffic (enabled=%v padding=%v): dummy polls=%d (real %d), dummy chunks=%d (real %d)\n",
+		ENABLE_COVER_TRAFFIC, ENABLE_LABEL_PADDING, cPolls, polls, cChunks, chunks)
+}
+
+// ───────────────────────── Double Ratchet ─────────────────────────
+//
+// Signal-style double ratchet on top of the X25519 identity keys, giving
+// forward secrecy for key version 4. The root secret is
+// HKDF(X25519(identities), "peyk-ratchet:<a>:<b>"). The node with the smaller
+// ID is the initiator: its first ratchet key is fresh and the responder's
+// first ratchet key is its identity key, so the responder can only send v4
+// after it has received once (until then it falls back to v3).
+//
+// Wire header (40 bytes, bound as AES-GCM additional data with the version):
+//
+//	ratchetPub[32] | PN (u32) | N (u32)
+//
+// The chunk/poll path delivers messages out of order and more than once, so
+// keys for skipped messages are kept (bounded by RATCHET_MAX_SKIP per step and
+// RATCHET_MAX_SKIPPED per session, oldest evicted first) and every decrypt
+// runs on a copy of the session that is committed only when the tag verifies.
+
+const RATCHET_HEADER_LEN = 32 + 4 + 4
+
+type skippedKey struct {
+	DH []byte `json:"dh"`
+	N  uint32 `json:"n"`
+	MK []byte `json:"mk"`
+}
+
+type ratchetSession struct {
+	DHs     []byte       `json:"dhs"` // our current ratchet private key
+	DHr     []byte       `json:"dhr,omitempty"`
+	RK      []byte       `json:"rk"`
+	CKs     []byte       `json:"cks,omitempty"`
+	CKr     []byte       `json:"ckr,omitempty"`
+	Ns      uint32       `json:"ns"`
+	Nr      uint32       `json:"nr"`
+	PN      uint32       `json:"pn"`
+	Skipped []skippedKey `json:"skipped,omitempty"`
+}
+
+func (r *ratchetSession) clone() *ratchetSession {
+	c := *r
+	c.Skipped = append([]skippedKey(nil), r.Skipped...)
+	return &c
+}
+
+func kdfRK(rk, dhOut []byte) ([]byte, []byte) {
+	out, err := hkdf.Key(sha256.New, dhOut, rk, "peyk-ratchet-rk", 64)
+	if err != nil {
+		log.Fatalf("ratchet kdf: %v", err)
+	}
+	return out[:32], out[32:]
+}
+
+func kdfCK(ck []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x01})
+	mk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x02})
+	return mac.Sum(nil), mk
+}
+
+func x25519(privBytes, pubBytes []byte) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(privBytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ecdh.X25519().NewPublicKey(pubBytes)
+	if err != nil {
+		return nil, err
+	}
+	return priv.ECDH(pub)
+}
+
+// ratchetSessionLocked returns (creating if needed) the session with peer. ksMu must be held.
+func ratchetSessionLocked(peer string) (*ratchetSession, error) {
+	if sess, ok := ksSessions[peer]; ok {
+		return sess, nil
+	}
+	peerPub, ok := ksContacts[peer]
+	if !ok {
+		return nil, fmt.Errorf("no key pinned for %s", peer)
+	}
+	shared, err := ksPriv.ECDH(peerPub)
+	if err != nil {
+		return nil, err
+	}
+	me := strings.ToLower(MY_ID)
+	a, b := me, peer
+	if a > b {
+		a, b = b, a
+	}
+	sk, err := hkdf.Key(sha256.New, shared, nil, "peyk-ratchet:"+a+":"+b, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &ratchetSession{RK: sk}
+	if me < peer {
+		// initiator: fresh ratchet key against the responder's identity key
+		dhs, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		dhOut, err := dhs.ECDH(peerPub)
+		if err != nil {
+			return nil, err
+		}
+		sess.DHs = dhs.Bytes()
+		sess.DHr = peerPub.Bytes()
+		sess.RK, sess.CKs = kdfRK(sk, dhOut)
+	} else {
+		// responder: identity key is the first ratchet key, no sending chain yet
+		sess.DHs = ksPriv.Bytes()
+	}
+	ksSessions[peer] = sess
+	return sess, nil
+}
+
+func ratchetCanSend(peer string) bool {
+	peer = strings.ToLower(peer)
+	ksMu.Lock()
+	defer ksMu.Unlock()
+	sess, err := ratchetSessionLocked(peer)
+	return err == nil && sess.CKs != nil
+}
+
+func ratchetEncrypt(peer string, plain []byte) ([]byte, error) {
+	peer = strings.ToLower(peer)
+	ksMu.Lock()
+	defer ksMu.Unlock()
+
+	sess, err := ratchetSessionLocked(peer)
+	if err != nil {
+		return nil, err
+	}
+	if sess.CKs == nil {
+		return nil, fmt.Errorf("session not established yet")
+	}
+	dhs, err := ecdh.X25519().NewPrivateKey(sess.DHs)
+	if err != nil {
+		return nil, err
+	}
+
+	var mk []byte
+	sess.CKs, mk = kdfCK(sess.CKs)
+	header := make([]byte, 0, 1+RATCHET_HEADER_LEN)
+	header = append(header, KEY_VERSION_RATCHET)
+	header = append(header, dhs.PublicKey().Bytes()...)
+	header = binary.BigEndian.AppendUint32(header, sess.PN)
+	header = binary.BigEndian.AppendUint32(header, sess.Ns)
+	sess.Ns++
+
+	if err := saveKeystoreLocked(); err != nil {
+		fmt.Printf("⚠️ Could not save ratchet state: %v\n", err)
+	}
+	return append(header, sealGCM(mk, plain, header)...), nil
+}
+
+func ratchetDecrypt(peer string, data []byte) ([]byte, error) {
+	if len(data) < 1+RATCHET_HEADER_LEN+12+16 {
+		return nil, fmt.Errorf("ratchet message too short")
+	}
+	header, body := data[:1+RATCHET_HEADER_LEN], data[1+RATCHET_HEADER_LEN:]
+	dh := header[1:33]
+	pn := binary.BigEndian.Uint32(header[33:37])
+	n := binary.BigEndian.Uint32(header[37:41])
+
+	ksMu.Lock()
+	defer ksMu.Unlock()
+
+	cur, err := ratchetSessionLocked(peer)
+	if err != nil {
+		return nil, err
+	}
+	sess := cur.clone()
+
+	// 1) a message we skipped earlier
+	for i, sk := range sess.Skipped {
+		if sk.N == n && bytes.Equal(sk.DH, dh) {
+			plain, err := openGCM(sk.MK, body, header)
+			if err != nil {
+				return nil, err
+			}
+			sess.Skipped = append(sess.Skipped[:i], sess.Skipped[i+1:]...)
+			return plain, commitRatchetLocked(peer, sess)
+		}
+	}
+
+	// 2) new ratchet key from the peer: finish the old chain, then DH-ratchet
+	if !bytes.Equal(dh, sess.DHr) {
+		if err := sess.skipUntil(pn); err != nil {
+			return nil, err
+		}
+		sess.PN = sess.Ns
+		sess.Ns, sess.Nr = 0, 0
+		sess.DHr = append([]byte(nil), dh...)
+		dhOut, err := x25519(sess.DHs, sess.DHr)
+		if err != nil {
+			return nil, err
+		}
+		sess.RK, sess.CKr = kdfRK(sess.RK, dhOut)
+		next, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		sess.DHs = next.Bytes()
+		if dhOut, err = x25519(sess.DHs, sess.DHr); err != nil {
+			return nil, err
+		}
+		sess.RK, sess.CKs = kdfRK(sess.RK, dhOut)
+	}
+
+	// 3) advance the receiving chain to n
+	if n < sess.Nr {
+		return nil, fmt.Errorf("duplicate or replayed ratchet message n=%d", n)
+	}
+	if err := sess.skipUntil(n); err != nil {
+		return nil, err
+	}
+	var mk []byte
+	sess.CKr, mk = kdfCK(sess.CKr)
+	sess.Nr++
+
+	plain, err := openGCM(mk, body, header)
+	if err != nil {
+		return nil, err
+	}
+	return plain, commitRatchetLocked(peer, sess)
+}
+
+// skipUntil stores message keys for the current receiving chain up to (not including) until.
+func (r *ratchetSession) skipUntil(until uint32) error {
+	if r.CKr == nil {
+		return nil
+	}
+	if until > r.Nr && until-r.Nr > RATCHET_MAX_SKIP {
+		return fmt.Errorf("too many skipped messages (%d)", until-r.Nr)
+	}
+	for r.Nr < until {
+		var mk []byte
+		r.CKr, mk = kdfCK(r.CKr)
+		r.Skipped = append(r.Skipped, skippedKey{DH: append([]byte(nil), r.DHr...), N: r.Nr, MK: mk})
+		r.Nr++
+	}
+	if over := len(r.Skipped) - RATCHET_MAX_SKIPPED; over > 0 {
+		r.Skipped = append([]skippedKey(nil), r.Skipped[over:]...)
+	}
+	return nil
+}
+
+// commitRatchetLocked replaces the session after a successful decrypt. ksMu must be held.
+func commitRatchetLocked(peer string, sess *ratchetSession) error {
+	ksSessions[peer] = sess
+	if err := saveKeystoreLocked(); err != nil {
+		fmt.Printf("⚠️ Could not save ratchet state: %v\n", err)
+	}
+	return nil
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base32"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// init() in simulator.go needs a domain, passphrase and node IDs; package variables
+// are set up before it runs. Few KDF iterations keep the tests fast.
+var (
+	_ = os.Setenv("PEYK_DOMAIN", "t.test")
+	_ = os.Setenv("PEYK_PASSPHRASE", "test passphrase")
+	_ = os.Setenv("PEYK_NODE_ID", "simulaaaaa")
+	_ = os.Setenv("PEYK_TARGET_ID", "targetaaaa")
+	_ = os.Setenv("PEYK_KDF_ITERATIONS", "1000")
+)
+
+func TestParseStatAnswer(t *testing.T) {
+	tests := []struct {
+		txt       string
+		missing   []int
+		delivered bool
+		ok        bool
+	}{
+		{"STAT-NONE", []int{0, 1, 2}, false, true},
+		{"STAT-DELIVERED", nil, true, true},
+		{"STAT-3-40", []int{0, 2}, false, true},
+		{"STAT-3-e0", nil, false, true},
+		{"STAT-9-ff", nil, false, false},
+		{"NOP", nil, false, false},
+		{"", nil, false, false},
+	}
+	for _, tt := range tests {
+		missing, delivered, ok := parseStatAnswer(tt.txt, 3)
+		if !reflect.DeepEqual(missing, tt.missing) || delivered != tt.delivered || ok != tt.ok {
+			t.Errorf("parseStatAnswer(%q) = %v, %v, %v; want %v, %v, %v",
+				tt.txt, missing, delivered, ok, tt.missing, tt.delivered, tt.ok)
+		}
+	}
+}
+
+func TestObfuscatedChunkNamesFit(t *testing.T) {
+	domain, channels := BASE_DOMAIN, CHANNELS
+	t.Cleanup(func() {
+		BASE_DOMAIN, CHANNELS = domain, channels
+		OBFUSCATION, obfsMaxPrefix = "", 0
+	})
+	BASE_DOMAIN = "relay-0123456789.example.co.uk" // long enough that words must shrink chunks
+	const cid = "chanaaaa"
+	CHANNELS = map[string][]string{cid: {MY_ID}}
+
+	for name, codec := range labelCodecs {
+		OBFUSCATION, obfsMaxPrefix = name, obfsPrefixBudget(codec)
+		label := strings.Repeat("z", chunkLabelMax(cid))
+		prefix := label + ".s" + strings.Repeat("z", PUBLISH_MAC_LEN) +
+			".a" + strings.Repeat("z", ACK2_MAC_LEN) + "." + replayToken()
+		if len(prefix) > obfsMaxPrefix {
+			t.Fatalf("%s: channel chunk 1 is %d chars, budget %d", name, len(prefix), obfsMaxPrefix)
+		}
+		for i := 0; i < 200; i++ { // the seal nonce changes the encoded length
+			sealed, _ := obfsSeal(obfsKey, prefix)
+			if n, max := len(codec.Encode(sealed)), codec.MaxLen(len(sealed)); n > max {
+				t.Fatalf("%s: encoded %d chars, MaxLen says %d", name, n, max)
+			}
+			if q := queryName(prefix); strings.HasPrefix(q, label) || len(q) > MAX_QNAME_LEN {
+				t.Fatalf("%s: channel chunk 1 not disguised within %d chars: %q", name, MAX_QNAME_LEN, q)
+			}
+		}
+	}
+}
+
+// Samples of typical emergency chat traffic, split by script so the dictionary's
+// effect on each shows separately.
+var (
+	latinCorpus = []string{
+		"ok",
+		"are you safe?",
+		"we are at home, everyone is fine. the internet is down here.",
+		"Please call me when you can, no electricity since last night and phones are dead.",
+		"Meet at the hospital entrance tomorrow morning at 9, bring water and food for two days.",
+		"Status update: road to the north is closed, we take the coast road. ETA 18:00.",
+	}
+	persianCorpus = []string{
+		"سلام",
+		"حالتون خوبه؟",
+		"ما در خانه هستیم، همه خوب هستند. اینترنت قطع است.",
+		"برق از دیشب قطع است، لطفا هر وقت تونستی زنگ بزن و خبر بده.",
+		"فردا صبح ساعت ۹ جلوی بیمارستان همدیگر را ببینیم، آب و غذا برای دو روز بیاور.",
+		"جاده شمال بسته است، از جاده ساحلی می‌رویم. ساعت ۱۸ می‌رسیم.",
+	}
+)
+
+// BenchmarkCompress times encode+decode of each corpus with compression off and on,
+// and reports what one pass over the corpus costs on the wire: envelope bytes and
+// chunks at the real chunk room.
+func BenchmarkCompress(b *testing.B) {
+	for _, corpus := range []struct {
+		name string
+		msgs []string
+	}{{"latin", latinCorpus}, {"persian", persianCorpus}} {
+		for _, compress := range []bool{false, true} {
+			name := corpus.name + "/raw"
+			if compress {
+				name = corpus.name + "/deflate"
+			}
+			b.Run(name, func(b *testing.B) {
+				var envBytes, chunks int
+				for _, msg := range corpus.msgs {
+					env := benchEnvelope(msg)
+					plain := encodeEnvelope(env, compress)
+					ct := encrypt(plain, MY_ID, TARGET_ID, SEND_KEY_VERSION)
+					room := chunkRoom(TARGET_ID, env.MsgID, []string{"v2"})
+					envBytes += len(plain)
+					chunks += (base32.StdEncoding.WithPadding(base32.NoPadding).EncodedLen(len(ct)) + room - 1) / room
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					msg := corpus.msgs[i%len(corpus.msgs)]
+					if _, err := decodeEnvelope(encodeEnvelope(benchEnvelope(msg), compress)); err != nil {
+						b.Fatalf("round-trip %q: %v", msg, err)
+					}
+				}
+				b.ReportMetric(float64(envBytes), "envelope-B")
+				b.ReportMetric(float64(chunks), "chunks")
+			})
+		}
+	}
+}
+
+func benchEnvelope(msg string) msgEnvelope {
+	return msgEnvelope{Type: MSG_TYPE_TEXT, SenderID: MY_ID, MsgID: "benchmid", SentAt: time.Now(), Body: []byte(msg)}
+}